@@ -1,27 +1,162 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/internal/logging"
 	"github.com/yifeng-qiu/StreamSaver/internal/server"
 	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
 )
 
-var addr = flag.String("addr", ":1718", "http service address")
+// httpShutdownTimeout is how long open requests may take to finish once the downloads are stopped
+const httpShutdownTimeout = 5 * time.Second
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := runTokenCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if _, err := logging.Setup(os.Stderr, cfg.Log.Format, cfg.Log.Level); err != nil {
+		log.Fatal("Invalid log configuration: ", err)
+	}
+	// from here on the log package writes through the structured logger
+	if effective, err := json.Marshal(cfg); err == nil {
+		slog.Info("effective configuration", "config", json.RawMessage(effective))
+	}
+
+	var stateStore store.Store = store.NopStore{}
+	if cfg.StateDir != "" {
+		fileStore, err := store.NewFileStore(cfg.StateDir)
+		if err != nil {
+			log.Fatal("Unable to open state store:", err)
+		}
+		stateStore = fileStore
+	}
+
 	myServer := &server.RequestHandler{
 		Requests:        make(map[string]server.Request),
-		DownloadManager: downloader.NewDownloadManager(),
+		DownloadManager: downloader.NewDownloadManager(cfg.Downloader, stateStore, nil),
+		Store:           stateStore,
+		Config:          cfg,
+	}
+	if cfg.Server.PlaybackKeyFile != "" {
+		key, err := server.LoadPlaybackKey(cfg.Server.PlaybackKeyFile)
+		if err != nil {
+			log.Fatal("Unable to load playback key:", err)
+		}
+		myServer.Playback = server.NewPlaybackSigner(key, cfg.Server.PlaybackURLTTL.Duration)
+	}
+	if cfg.Server.Auth {
+		tokens, err := server.NewTokenStore(stateStore)
+		if err != nil {
+			log.Fatal("Unable to load tokens:", err)
+		}
+		if len(tokens.List()) == 0 {
+			slog.Warn("no device token exists yet, create one with: streamsaver token create -device NAME -admin")
+		}
+		myServer.Tokens = tokens
+	}
+	if err := myServer.Restore(); err != nil {
+		log.Fatal("Unable to restore requests:", err)
+	}
+	if err := myServer.DownloadManager.Restore(); err != nil {
+		log.Fatal("Unable to restore sessions:", err)
 	}
 
-	myhttpServer := myServer.NewHTTPServer(*addr)
+	myhttpServer := myServer.NewHTTPServer(cfg.Server)
+	// canceled on shutdown so that streaming responses end and the server can drain
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	myhttpServer.BaseContext = func(net.Listener) context.Context { return baseCtx }
 
-	err := myhttpServer.ListenAndServe()
-	if err != nil {
+	var redirectServer *http.Server
+	if cfg.Server.TLS() {
+		certificates, err := server.NewTLSReloader(cfg.Server)
+		if err != nil {
+			log.Fatal("Unable to load TLS certificate:", err)
+		}
+		myhttpServer.TLSConfig = certificates.TLSConfig()
+		// certificates renewed on disk are picked up without a restart
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := certificates.Reload(); err != nil {
+					slog.Error("TLS certificate not reloaded", "error", err)
+				} else {
+					slog.Info("TLS certificate reloaded")
+				}
+			}
+		}()
+		if cfg.Server.RedirectAddr != "" {
+			redirectServer = server.NewRedirectServer(cfg.Server)
+		}
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 2)
+	go func() {
+		if cfg.Server.TLS() {
+			// the certificate comes from the TLS config
+			serveErr <- myhttpServer.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- myhttpServer.ListenAndServe()
+		}
+	}()
+	if redirectServer != nil {
+		go func() {
+			if err := redirectServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
 		log.Fatal("ListenAndServe:", err)
+	case <-signals.Done():
 	}
+	// a second signal terminates immediately
+	stop()
 
+	grace := cfg.Server.ShutdownGracePeriod.Duration
+	slog.Info("shutting down", "gracePeriod", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := myServer.DownloadManager.Shutdown(ctx); err != nil {
+		slog.Warn("downloads interrupted", "error", err)
+	}
+	cancelRequests()
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+	// the requests get their own time, the downloads may have used up the grace period
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancelHTTP()
+	if err := myhttpServer.Shutdown(httpCtx); err != nil {
+		slog.Warn("closing open connections", "error", err)
+		myhttpServer.Close()
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server stopped", "error", err)
+	}
+	slog.Info("shutdown complete")
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/internal/server"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// tokenUsage lists the subcommands of the token command
+const tokenUsage = "usage: streamsaver token create -device NAME [-user NAME] [-admin] [-- settings]\n" +
+	"       streamsaver token revoke ID [-- settings]"
+
+// runTokenCommand implements "streamsaver token create" and "streamsaver token revoke".
+// It issues or revokes a device token directly in the state directory, which is how the
+// first admin token is created. Settings after "--" are read like those of the server,
+// e.g. -state. A running server picks up the change within a few seconds.
+func runTokenCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	switch args[0] {
+	case "create":
+		return createToken(args[1:], stdout)
+	case "revoke":
+		return revokeToken(args[1:], stdout)
+	default:
+		return errors.New(tokenUsage)
+	}
+}
+
+// createToken issues a token and prints it
+func createToken(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("streamsaver token create", flag.ContinueOnError)
+	device := fs.String("device", "", "name of the device receiving the token")
+	user := fs.String("user", "", "user owning the downloads of the device, defaults to the device name")
+	admin := fs.Bool("admin", false, "allow the token to manage tokens and the configuration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tokens, err := openTokenStore(fs.Args())
+	if err != nil {
+		return err
+	}
+	token, created, err := tokens.Create(*device, *user, *admin)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Token %s for %q of user %q (admin: %t), it is not shown again:\n%s\n",
+		created.ID, created.Device, created.Owner(), created.Admin, token)
+	return nil
+}
+
+// revokeToken removes the token with the ID given as first argument
+func revokeToken(args []string, stdout io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New(tokenUsage)
+	}
+	id, settings := args[0], args[1:]
+	if len(settings) > 0 && settings[0] == "--" {
+		settings = settings[1:]
+	}
+	tokens, err := openTokenStore(settings)
+	if err != nil {
+		return err
+	}
+	if err := tokens.Revoke(id); err != nil {
+		return fmt.Errorf("unable to revoke %s: %w", id, err)
+	}
+	fmt.Fprintf(stdout, "Token %s revoked\n", id)
+	return nil
+}
+
+// openTokenStore loads the tokens of the state directory named by the settings
+func openTokenStore(settings []string) (*server.TokenStore, error) {
+	cfg, err := config.Load(settings, os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if cfg.StateDir == "" {
+		return nil, errors.New("tokens are kept in the state directory, which is disabled")
+	}
+	stateStore, err := store.NewFileStore(cfg.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewTokenStore(stateStore)
+}
@@ -0,0 +1,324 @@
+// Package config loads the settings of StreamSaver. Values are taken from the built-in
+// defaults, then a JSON config file, then STREAMSAVER_* environment variables and finally
+// command line flags, each source overriding the previous ones.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/logging"
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+)
+
+// Config is the effective configuration of the server
+type Config struct {
+	Server     ServerConfig      `json:"server"`
+	StateDir   string            `json:"stateDir"` // persisted requests and sessions, empty to disable
+	Downloader downloader.Config `json:"downloader"`
+	Log        LogConfig         `json:"log"`
+}
+
+// ServerConfig holds the settings of the HTTP server
+type ServerConfig struct {
+	Addr                string          `json:"addr"`
+	ReadTimeout         helper.Duration `json:"readTimeout"`
+	WriteTimeout        helper.Duration `json:"writeTimeout"`
+	IdleTimeout         helper.Duration `json:"idleTimeout"`
+	ShutdownGracePeriod helper.Duration `json:"shutdownGracePeriod"` // time allowed on SIGINT or SIGTERM for conversions and requests to finish
+	ServeMedia          bool            `json:"serveMedia"`          // serve the HLS root at /hls/ and the download root at /media/
+	PlaybackKeyFile     string          `json:"playbackKeyFile"`     // key signing playback URLs, generated if missing, empty to disable signing
+	PlaybackURLTTL      helper.Duration `json:"playbackUrlTtl"`      // validity of a signed playback URL
+	Auth                bool            `json:"auth"`                // require a device token, see the token command
+	TLSCertFile         string          `json:"tlsCertFile"`         // certificate chain in PEM, reloaded on SIGHUP, empty to serve plain HTTP
+	TLSKeyFile          string          `json:"tlsKeyFile"`          // private key of the certificate in PEM
+	TLSClientCAFile     string          `json:"tlsClientCaFile"`     // CA certificates of client certificates accepted in place of a token, empty to disable
+	RedirectAddr        string          `json:"redirectAddr"`        // plain HTTP address redirecting to HTTPS, empty to disable
+}
+
+// TLS reports whether the server is served over HTTPS
+func (c ServerConfig) TLS() bool {
+	return c.TLSCertFile != ""
+}
+
+// LogConfig holds the settings of the logger
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn or error, can be changed at runtime
+	Format string `json:"format"` // text or json
+}
+
+const envConfigFile = "STREAMSAVER_CONFIG"
+
+// Default returns the configuration used when nothing else is specified
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:                ":1718",
+			ReadTimeout:         helper.Duration{Duration: 15 * time.Second},
+			WriteTimeout:        helper.Duration{Duration: 15 * time.Second},
+			IdleTimeout:         helper.Duration{Duration: 60 * time.Second},
+			ShutdownGracePeriod: helper.Duration{Duration: 30 * time.Second},
+			PlaybackURLTTL:      helper.Duration{Duration: 6 * time.Hour},
+		},
+		StateDir:   "/media/download/.streamsaver",
+		Downloader: downloader.DefaultConfig(),
+		Log:        LogConfig{Level: "info", Format: logging.FORMAT_TEXT},
+	}
+}
+
+// setting binds one configuration value to a flag and an environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	get   func(c *Config) string
+	set   func(c *Config, value string) error
+}
+
+func stringSetting(name string, env string, usage string, field func(c *Config) *string) setting {
+	return setting{
+		flag: name, env: env, usage: usage,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func intSetting(name string, env string, usage string, field func(c *Config) *int) setting {
+	return setting{
+		flag: name, env: env, usage: usage,
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func boolSetting(name string, env string, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		flag: name, env: env, usage: usage,
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func durationSetting(name string, env string, usage string, field func(c *Config) *helper.Duration) setting {
+	return setting{
+		flag: name, env: env, usage: usage,
+		get: func(c *Config) string { return field(c).String() },
+		set: func(c *Config, value string) error {
+			v, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field(c).Duration = v
+			return nil
+		},
+	}
+}
+
+func settings() []setting {
+	return []setting{
+		stringSetting("addr", "STREAMSAVER_ADDR", "http service address",
+			func(c *Config) *string { return &c.Server.Addr }),
+		durationSetting("read-timeout", "STREAMSAVER_READ_TIMEOUT", "maximum duration for reading a request",
+			func(c *Config) *helper.Duration { return &c.Server.ReadTimeout }),
+		durationSetting("write-timeout", "STREAMSAVER_WRITE_TIMEOUT", "maximum duration for writing a response",
+			func(c *Config) *helper.Duration { return &c.Server.WriteTimeout }),
+		durationSetting("idle-timeout", "STREAMSAVER_IDLE_TIMEOUT", "maximum idle time of a keep-alive connection",
+			func(c *Config) *helper.Duration { return &c.Server.IdleTimeout }),
+		durationSetting("shutdown-grace-period", "STREAMSAVER_SHUTDOWN_GRACE_PERIOD", "time allowed for conversions and requests to finish on shutdown",
+			func(c *Config) *helper.Duration { return &c.Server.ShutdownGracePeriod }),
+		boolSetting("auth", "STREAMSAVER_AUTH", "require a bearer token issued to the device, see the token command",
+			func(c *Config) *bool { return &c.Server.Auth }),
+		boolSetting("serve-media", "STREAMSAVER_SERVE_MEDIA", "serve the HLS output at /hls/ and the downloaded files at /media/",
+			func(c *Config) *bool { return &c.Server.ServeMedia }),
+		stringSetting("playback-key-file", "STREAMSAVER_PLAYBACK_KEY_FILE", "key signing playback URLs, generated if missing, empty to disable signing",
+			func(c *Config) *string { return &c.Server.PlaybackKeyFile }),
+		durationSetting("playback-url-ttl", "STREAMSAVER_PLAYBACK_URL_TTL", "validity of a signed playback URL",
+			func(c *Config) *helper.Duration { return &c.Server.PlaybackURLTTL }),
+		stringSetting("tls-cert-file", "STREAMSAVER_TLS_CERT_FILE", "certificate chain in PEM, reloaded on SIGHUP, empty to serve plain HTTP",
+			func(c *Config) *string { return &c.Server.TLSCertFile }),
+		stringSetting("tls-key-file", "STREAMSAVER_TLS_KEY_FILE", "private key of the TLS certificate in PEM",
+			func(c *Config) *string { return &c.Server.TLSKeyFile }),
+		stringSetting("tls-client-ca-file", "STREAMSAVER_TLS_CLIENT_CA_FILE", "CA certificates of client certificates accepted in place of a token, empty to disable",
+			func(c *Config) *string { return &c.Server.TLSClientCAFile }),
+		stringSetting("redirect-addr", "STREAMSAVER_REDIRECT_ADDR", "plain HTTP address redirecting to HTTPS, empty to disable",
+			func(c *Config) *string { return &c.Server.RedirectAddr }),
+		stringSetting("state", "STREAMSAVER_STATE_DIR", "directory for persisting requests and sessions, empty to disable",
+			func(c *Config) *string { return &c.StateDir }),
+		stringSetting("download-root", "STREAMSAVER_DOWNLOAD_ROOT", "directory receiving the downloads, must match the yt-dlp output template",
+			func(c *Config) *string { return &c.Downloader.DownloadRoot }),
+		stringSetting("hls-root", "STREAMSAVER_HLS_ROOT", "directory receiving the HLS output",
+			func(c *Config) *string { return &c.Downloader.HLSRoot }),
+		intSetting("domain-queue-size", "STREAMSAVER_DOMAIN_QUEUE_SIZE", "concurrent downloads per domain",
+			func(c *Config) *int { return &c.Downloader.DomainQueueSize }),
+		intSetting("ffmpeg-slots", "STREAMSAVER_FFMPEG_SLOTS", "concurrent HLS conversions",
+			func(c *Config) *int { return &c.Downloader.FFmpegSlots }),
+		durationSetting("hls-segment-length", "STREAMSAVER_HLS_SEGMENT_LENGTH", "target duration of an HLS segment",
+			func(c *Config) *helper.Duration { return &c.Downloader.HLSSegmentLength }),
+		stringSetting("hls-audio-codec", "STREAMSAVER_HLS_AUDIO_CODEC", "codec of audio-only HLS renditions, aac or opus",
+			func(c *Config) *string { return &c.Downloader.HLSAudioCodec }),
+		stringSetting("ytdlp", "STREAMSAVER_YTDLP", "path to the yt-dlp binary",
+			func(c *Config) *string { return &c.Downloader.Binaries.YtDlp }),
+		stringSetting("ffmpeg", "STREAMSAVER_FFMPEG", "path to the ffmpeg binary",
+			func(c *Config) *string { return &c.Downloader.Binaries.FFmpeg }),
+		stringSetting("ffprobe", "STREAMSAVER_FFPROBE", "path to the ffprobe binary",
+			func(c *Config) *string { return &c.Downloader.Binaries.FFprobe }),
+		durationSetting("stall-timeout", "STREAMSAVER_STALL_TIMEOUT", "inactivity after which yt-dlp or ffmpeg is terminated and rescheduled, 0 to disable",
+			func(c *Config) *helper.Duration { return &c.Downloader.StallTimeout }),
+		durationSetting("probe-timeout", "STREAMSAVER_PROBE_TIMEOUT", "maximum duration of a metadata probe through POST /probe",
+			func(c *Config) *helper.Duration { return &c.Downloader.ProbeTimeout }),
+		intSetting("retry-max-attempts", "STREAMSAVER_RETRY_MAX_ATTEMPTS", "runs of a failing download including the first one, 1 disables retries",
+			func(c *Config) *int { return &c.Downloader.Retry.MaxAttempts }),
+		durationSetting("retry-initial-backoff", "STREAMSAVER_RETRY_INITIAL_BACKOFF", "delay before the first automatic retry",
+			func(c *Config) *helper.Duration { return &c.Downloader.Retry.InitialBackoff }),
+		durationSetting("retry-max-backoff", "STREAMSAVER_RETRY_MAX_BACKOFF", "upper bound of the delay between automatic retries",
+			func(c *Config) *helper.Duration { return &c.Downloader.Retry.MaxBackoff }),
+		intSetting("user-max-concurrent", "STREAMSAVER_USER_MAX_CONCURRENT", "concurrent downloads of each user with authentication enabled, 0 for no limit",
+			func(c *Config) *int { return &c.Downloader.UserLimits.MaxConcurrent }),
+		stringSetting("session-log-dir", "STREAMSAVER_SESSION_LOG_DIR", "directory receiving the tool output of each session, empty to disable",
+			func(c *Config) *string { return &c.Downloader.SessionLogDir }),
+		intSetting("session-log-max-bytes", "STREAMSAVER_SESSION_LOG_MAX_BYTES", "size at which a session log is rotated",
+			func(c *Config) *int { return &c.Downloader.SessionLogMaxBytes }),
+		stringSetting("log-level", "STREAMSAVER_LOG_LEVEL", "minimum level of log records: debug, info, warn or error",
+			func(c *Config) *string { return &c.Log.Level }),
+		stringSetting("log-format", "STREAMSAVER_LOG_FORMAT", "format of log records: text or json",
+			func(c *Config) *string { return &c.Log.Format }),
+	}
+}
+
+// Load builds the configuration from the command line arguments (without the program name)
+// and the environment, then validates it
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+	defaults := Default()
+
+	fs := flag.NewFlagSet("streamsaver", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a JSON config file, also read from "+envConfigFile)
+	all := settings()
+	for _, s := range all {
+		fs.String(s.flag, s.get(&defaults), s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv(envConfigFile)
+	}
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range all {
+		if value, ok := lookupEnv(s.env); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range all {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.set(&cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("invalid value for -%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadFile decodes a JSON config file on top of cfg. Unknown keys are rejected so that
+// typos do not go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		return fmt.Errorf("invalid addr %q: %w", c.Server.Addr, err)
+	}
+	if c.Server.ReadTimeout.Duration < 0 || c.Server.WriteTimeout.Duration < 0 || c.Server.IdleTimeout.Duration < 0 {
+		return fmt.Errorf("server timeouts cannot be negative")
+	}
+	if c.Server.ShutdownGracePeriod.Duration < 0 {
+		return fmt.Errorf("shutdownGracePeriod cannot be negative, got %s", c.Server.ShutdownGracePeriod)
+	}
+	if c.Server.Auth && c.StateDir == "" {
+		return fmt.Errorf("auth requires a state directory for the tokens")
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if c.Server.TLSClientCAFile != "" && !c.Server.TLS() {
+		return fmt.Errorf("tlsClientCaFile requires tlsCertFile and tlsKeyFile")
+	}
+	if c.Server.RedirectAddr != "" {
+		if !c.Server.TLS() {
+			return fmt.Errorf("redirectAddr requires tlsCertFile and tlsKeyFile")
+		}
+		if _, _, err := net.SplitHostPort(c.Server.RedirectAddr); err != nil {
+			return fmt.Errorf("invalid redirectAddr %q: %w", c.Server.RedirectAddr, err)
+		}
+	}
+	if c.Server.PlaybackKeyFile != "" && c.Server.PlaybackURLTTL.Duration <= 0 {
+		return fmt.Errorf("playbackUrlTtl must be positive, got %s", c.Server.PlaybackURLTTL)
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if !logging.ValidFormat(c.Log.Format) {
+		return fmt.Errorf("invalid log format %q", c.Log.Format)
+	}
+	if err := c.Downloader.Validate(); err != nil {
+		return fmt.Errorf("invalid downloader config: %w", err)
+	}
+	return nil
+}
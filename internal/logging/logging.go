@@ -0,0 +1,56 @@
+// Package logging configures the structured logger of StreamSaver. Records are written as
+// text or JSON and the level can be changed while the server is running.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+// Level is the minimum level of the default logger. It is shared by all loggers created
+// by Setup so that a change is visible immediately.
+var Level = new(slog.LevelVar)
+
+// ParseLevel converts a level name such as "debug" or "warn" into a slog.Level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return level, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+// ValidFormat reports whether format is a supported output format
+func ValidFormat(format string) bool {
+	return format == FORMAT_TEXT || format == FORMAT_JSON
+}
+
+// Setup installs a logger writing to w as the slog default and returns it.
+// The standard library log package is redirected to the same handler.
+func Setup(w io.Writer, format string, level string) (*slog.Logger, error) {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	Level.Set(parsed)
+	options := &slog.HandlerOptions{Level: Level}
+	var handler slog.Handler
+	switch format {
+	case FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, options)
+	case FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger, nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+const storeKindTokens = "tokens"
+
+// tokenPrefix marks the bearer tokens issued by the server
+const tokenPrefix = "ss_"
+
+// tokenReloadInterval is how often the tokens are read again from the state store
+const tokenReloadInterval = 5 * time.Second
+
+var ErrTokenNotFound = errors.New("token not found")
+var ErrDeviceNameRequired = errors.New("device name cannot be empty")
+
+// DeviceToken describes a bearer token issued to one device. The token itself is only
+// returned when it is created, the server keeps its SHA-256 hash.
+type DeviceToken struct {
+	ID      string    `json:"id"`
+	Device  string    `json:"device"`
+	User    string    `json:"user,omitempty"` // owner of the downloads of the device, the device name if empty
+	Admin   bool      `json:"admin"`          // may manage tokens and the configuration
+	Created time.Time `json:"created"`
+}
+
+// Owner returns the user the downloads of the device belong to
+func (t DeviceToken) Owner() string {
+	if t.User != "" {
+		return t.User
+	}
+	return t.Device
+}
+
+// tokenRecord is saved in the state store for each token
+type tokenRecord struct {
+	DeviceToken
+	Hash string `json:"hash"`
+}
+
+// TokenStore holds the device tokens, it is safe for concurrent use
+type TokenStore struct {
+	mu         sync.RWMutex
+	byHash     map[string]DeviceToken
+	store      store.Store
+	lastReload time.Time
+}
+
+// NewTokenStore loads the tokens saved in st
+func NewTokenStore(st store.Store) (*TokenStore, error) {
+	ts := &TokenStore{byHash: make(map[string]DeviceToken), store: st}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload replaces the tokens in memory by the tokens of the state store, so that
+// tokens created or revoked by the token command are picked up by a running server
+func (ts *TokenStore) reload() error {
+	// held while reading, a token created meanwhile is added once the tokens are replaced
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	byHash := make(map[string]DeviceToken)
+	err := ts.store.Load(storeKindTokens, func(key string, data []byte) error {
+		var record tokenRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.Hash == "" {
+			slog.Warn("skipping unreadable token record", "token", key)
+			return nil
+		}
+		byHash[record.Hash] = record.DeviceToken
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to load tokens %w", err)
+	}
+	ts.byHash = byHash
+	ts.lastReload = time.Now()
+	return nil
+}
+
+// Create issues a new token for a device of a user and returns the token with its
+// description. An empty user makes the device a user of its own.
+func (ts *TokenStore) Create(device string, user string, admin bool) (string, DeviceToken, error) {
+	device = strings.TrimSpace(device)
+	user = strings.TrimSpace(user)
+	if device == "" {
+		return "", DeviceToken{}, ErrDeviceNameRequired
+	}
+	secret := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(secret); err != nil {
+		return "", DeviceToken{}, fmt.Errorf("unable to generate token %w", err)
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", DeviceToken{}, fmt.Errorf("unable to generate token %w", err)
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	record := tokenRecord{
+		DeviceToken: DeviceToken{ID: hex.EncodeToString(id), Device: device, User: user, Admin: admin, Created: time.Now()},
+		Hash:        hashToken(token),
+	}
+	if err := ts.store.Put(storeKindTokens, record.ID, record); err != nil {
+		return "", DeviceToken{}, fmt.Errorf("unable to save token %w", err)
+	}
+	ts.mu.Lock()
+	ts.byHash[record.Hash] = record.DeviceToken
+	ts.mu.Unlock()
+	return token, record.DeviceToken, nil
+}
+
+// List returns the tokens ordered by creation time
+func (ts *TokenStore) List() []DeviceToken {
+	ts.mu.RLock()
+	tokens := make([]DeviceToken, 0, len(ts.byHash))
+	for _, token := range ts.byHash {
+		tokens = append(tokens, token)
+	}
+	ts.mu.RUnlock()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+// Revoke removes the token with the given ID
+func (ts *TokenStore) Revoke(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for hash, token := range ts.byHash {
+		if token.ID == id {
+			if err := ts.store.Delete(storeKindTokens, id); err != nil {
+				return fmt.Errorf("unable to remove token %w", err)
+			}
+			delete(ts.byHash, hash)
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// Authenticate returns the description of a valid token. A token revoked by the token
+// command is rejected within tokenReloadInterval.
+func (ts *TokenStore) Authenticate(token string) (DeviceToken, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return DeviceToken{}, false
+	}
+	ts.reloadIfStale()
+	ts.mu.RLock()
+	device, ok := ts.byHash[hashToken(token)]
+	ts.mu.RUnlock()
+	return device, ok
+}
+
+// reloadIfStale reloads the tokens if the last reload is older than tokenReloadInterval.
+// The tokens in memory are kept if the state store cannot be read.
+func (ts *TokenStore) reloadIfStale() {
+	ts.mu.Lock()
+	if time.Since(ts.lastReload) <= tokenReloadInterval {
+		ts.mu.Unlock()
+		return
+	}
+	// concurrent requests do not reload as well
+	ts.lastReload = time.Now()
+	ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		slog.Warn("unable to reload tokens", "error", err)
+	}
+}
+
+// hashToken returns the hex encoded SHA-256 of a token. Tokens are random, a plain
+// hash is enough to keep them out of the state directory.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type contextKey string
+
+const deviceTokenKey contextKey = "deviceToken"
+
+// requestDevice returns the token the request was authenticated with
+func requestDevice(req *http.Request) (DeviceToken, bool) {
+	device, ok := req.Context().Value(deviceTokenKey).(DeviceToken)
+	return device, ok
+}
+
+// bearerToken reads the token of the Authorization header
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Route name prefixes selecting the access rules of Authenticate
+const (
+	routePublic   = "public:"   // open to everyone
+	routePlayback = "playback:" // open when playback URLs are signed, the signature is checked instead
+	routeAdmin    = "admin:"    // requires an admin token
+)
+
+// Authenticate is a mux middleware rejecting requests without a valid bearer token or a
+// verified client certificate. The access rules of a route are given by the prefix of its
+// name, unnamed routes require a token or a certificate.
+func (s *RequestHandler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := ""
+		if route := mux.CurrentRoute(req); route != nil {
+			name = route.GetName()
+		}
+		if strings.HasPrefix(name, routePublic) || (strings.HasPrefix(name, routePlayback) && s.Playback != nil) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		device, ok := certificateDevice(req, s.Tokens == nil)
+		if !ok && s.Tokens != nil {
+			device, ok = s.Tokens.Authenticate(bearerToken(req))
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="streamsaver"`)
+			WriteHttpErrorMessage(w, "missing or invalid bearer token or client certificate", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(name, routeAdmin) && !device.Admin {
+			WriteHttpErrorMessage(w, "an admin token is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), deviceTokenKey, device)))
+	})
+}
+
+// NewTokenRequest is the JSON body of POST /tokens
+type NewTokenRequest struct {
+	Device string `json:"device"`
+	User   string `json:"user"`
+	Admin  bool   `json:"admin"`
+}
+
+// NewTokenResponse returns the token, it cannot be retrieved again
+type NewTokenResponse struct {
+	DeviceToken
+	Token string `json:"token"`
+}
+
+// CreateToken issues a token for the device named in a JSON encoded NewTokenRequest
+func (s *RequestHandler) CreateToken(w http.ResponseWriter, req *http.Request) {
+	var newToken NewTokenRequest
+	decoder := json.NewDecoder(io.LimitReader(req.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&newToken); err != nil {
+		WriteHttpErrorMessage(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, device, err := s.Tokens.Create(newToken.Device, newToken.User, newToken.Admin)
+	switch {
+	case errors.Is(err, ErrDeviceNameRequired):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInternalServerError)
+	default:
+		if issuer, ok := requestDevice(req); ok {
+			slog.Info("token created", "token", device.ID, "device", device.Device, "user", device.Owner(), "admin", device.Admin, "by", issuer.ID)
+		}
+		WriteJSONStatus(w, NewTokenResponse{DeviceToken: device, Token: token}, http.StatusCreated)
+	}
+}
+
+// ListTokens reports the tokens without their secrets
+func (s *RequestHandler) ListTokens(w http.ResponseWriter, req *http.Request) {
+	WriteJSONMessage(w, s.Tokens.List())
+}
+
+// RevokeToken removes a token, requests with it are rejected from then on
+func (s *RequestHandler) RevokeToken(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	err := s.Tokens.Revoke(id)
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		WriteHttpErrorMessage(w, id+" does not exist", http.StatusNotFound)
+	case err != nil:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInternalServerError)
+	default:
+		slog.Info("token revoked", "token", id)
+		WriteJSONMessage(w, map[string]string{"id": id})
+	}
+}
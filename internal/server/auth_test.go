@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// newTestTokens returns a token store saving into dir
+func newTestTokens(t *testing.T, dir string) *TokenStore {
+	t.Helper()
+	st, err := store.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenStore(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// expire makes the next Authenticate read the tokens again
+func (ts *TokenStore) expire() {
+	ts.mu.Lock()
+	ts.lastReload = time.Now().Add(-2 * tokenReloadInterval)
+	ts.mu.Unlock()
+}
+
+func TestCreateToken(t *testing.T) {
+	s := &RequestHandler{Requests: make(map[string]Request), Tokens: newTestTokens(t, t.TempDir())}
+	admin, _, err := s.Tokens.Create("laptop", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.NewHTTPServer(config.ServerConfig{Addr: "127.0.0.1:0"}).Handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/tokens", strings.NewReader(`{"device": "iPhone", "user": "alice"}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("POST /tokens answered %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var created NewTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding the token: %v", err)
+	}
+	device, ok := s.Tokens.Authenticate(created.Token)
+	if !ok || device.Device != "iPhone" || device.Owner() != "alice" || device.Admin {
+		t.Errorf("created token authenticates as %+v (%v)", device, ok)
+	}
+}
+
+func TestWriteJSONStatus(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	WriteJSONStatus(recorder, map[string]string{"id": "abc"}, http.StatusCreated)
+	if recorder.Code != http.StatusCreated || recorder.Body.String() != "{\"id\":\"abc\"}\n" {
+		t.Errorf("answered %d with %q", recorder.Code, recorder.Body.String())
+	}
+
+	// a value which cannot be encoded is reported instead of the status
+	recorder = httptest.NewRecorder()
+	WriteJSONStatus(recorder, func() {}, http.StatusCreated)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable response answered %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
+
+// TestTokenCommandChanges changes the tokens through a second store on the same state
+// directory, as the token command does while the server is running
+func TestTokenCommandChanges(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestTokens(t, dir)
+	command := newTestTokens(t, dir)
+
+	token, created, err := command.Create("tablet", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.expire()
+	if _, ok := server.Authenticate(token); !ok {
+		t.Fatal("token created by the command is not accepted")
+	}
+
+	if err := command.Revoke(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Authenticate(token); !ok {
+		t.Error("token rejected before the tokens are read again")
+	}
+	server.expire()
+	if _, ok := server.Authenticate(token); ok {
+		t.Error("token revoked by the command is still accepted")
+	}
+	if tokens := server.List(); len(tokens) != 0 {
+		t.Errorf("%d tokens listed after the revocation", len(tokens))
+	}
+}
+
+// TestMediaRouteAuthentication checks that signed playback opens /hls/ but leaves /media/
+// behind the tokens, no signed URL points into the download root
+func TestMediaRouteAuthentication(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{"video.mp4": "video", "abc/stream.m3u8": "#EXTM3U\n#EXT-X-ENDLIST\n"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := newTestTokens(t, t.TempDir())
+	token, _, err := tokens.Create("phone", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RequestHandler{Requests: make(map[string]Request), Config: &config.Config{}, Tokens: tokens,
+		Playback: NewPlaybackSigner(make([]byte, playbackKeySize), time.Hour)}
+	s.Config.Downloader.DownloadRoot = root
+	s.Config.Downloader.HLSRoot = root
+	server := httptest.NewServer(s.NewHTTPServer(config.ServerConfig{Addr: "127.0.0.1:0", ServeMedia: true}).Handler)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		code   int
+	}{
+		{"signed playlist", "/hls" + s.Playback.Sign("/abc/stream.m3u8"), "", http.StatusOK},
+		{"unsigned playlist", "/hls/abc/stream.m3u8", token, http.StatusForbidden},
+		{"media without token", "/media/video.mp4", "", http.StatusUnauthorized},
+		{"media with a signature", "/media" + s.Playback.Sign("/video.mp4"), "", http.StatusUnauthorized},
+		{"media with token", "/media/video.mp4", token, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+test.target, nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.code {
+				t.Errorf("GET %s answered %d, want %d", test.target, resp.StatusCode, test.code)
+			}
+		})
+	}
+}
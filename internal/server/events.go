@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+)
+
+// keepAliveInterval is how often a comment is sent on an idle event stream,
+// so that proxies do not close the connection
+const keepAliveInterval = 15 * time.Second
+
+// StreamEvents pushes session changes to the client as Server-Sent Events.
+// The stream starts with a "snapshot" event holding all sessions, followed by "update"
+// and "removed" events. Sessions can be filtered with one or more id query parameters,
+// either repeated or comma separated. Users only receive the events of their own sessions.
+// The stream ends when the client falls behind, EventSource clients reconnect and receive
+// a new snapshot.
+func (s *RequestHandler) StreamEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteHttpErrorMessage(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// the stream outlives the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	ids := make([]string, 0)
+	for _, value := range req.URL.Query()["id"] {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	events, cancel := s.DownloadManager.Subscribe(ids)
+	defer cancel()
+	owned := newEventFilter(req)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event, ok = owned.filter(event); !ok {
+				continue
+			}
+			if err := writeEvent(w, s.signEvent(event)); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// signEvent signs the playback URLs of the sessions of an event. The sessions of an event are
+// shared by all subscribers and are copied first.
+func (s *RequestHandler) signEvent(event downloader.SessionEvent) downloader.SessionEvent {
+	if s.Playback == nil {
+		return event
+	}
+	if event.Session != nil {
+		event.Session = s.signSession(event.Session.Snapshot())
+	}
+	sessions := make([]*downloader.Session, 0, len(event.Sessions))
+	for _, session := range event.Sessions {
+		sessions = append(sessions, s.signSession(session.Snapshot()))
+	}
+	event.Sessions = sessions
+	return event
+}
+
+// writeEvent encodes one event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event downloader.SessionEvent) error {
+	var payload any = event.Session
+	switch event.Type {
+	case downloader.EVENT_SNAPSHOT:
+		payload = event.Sessions
+	case downloader.EVENT_REMOVED:
+		payload = map[string]string{"id": event.ID}
+	}
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(payload); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, bytes.TrimRight(buffer.Bytes(), "\n"))
+	return err
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+)
+
+// logPollInterval is how often a followed session log is checked for new lines
+const logPollInterval = 500 * time.Millisecond
+
+// GetSessionLog returns the output of yt-dlp and ffmpeg recorded for a session as plain text.
+// With follow=true the connection is kept open and new lines are streamed as they are written.
+func (s *RequestHandler) GetSessionLog(w http.ResponseWriter, req *http.Request) {
+	shaKey := mux.Vars(req)["id"]
+	path, err := s.DownloadManager.SessionLogPath(shaKey)
+	switch {
+	case errors.Is(err, downloader.ErrSessionNotFound) || !s.canAccess(req, shaKey):
+		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
+		return
+	case err != nil:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	follow, _ := strconv.ParseBool(req.URL.Query().Get("follow"))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !follow {
+		w.WriteHeader(http.StatusOK)
+		copyLogFile(w, path+".1")
+		copyLogFile(w, path)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteHttpErrorMessage(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// the stream outlives the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	copyLogFile(w, path+".1")
+	log := &followedLog{path: path}
+	defer log.Close()
+	log.copyTo(w)
+	flusher.Flush()
+
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			if log.copyTo(w) > 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// followedLog keeps the session log open between polls so that a rotation, which renames
+// the file, can be told apart from new lines and the rest of the old file is not lost
+type followedLog struct {
+	path string
+	file *os.File
+	info os.FileInfo
+}
+
+// copyTo writes the lines added since the last call, finishing the old file first when
+// the log was rotated. It returns the number of bytes written.
+func (l *followedLog) copyTo(w io.Writer) int64 {
+	// the file is checked before it is read, the writer closes it before the rotation
+	info, statErr := os.Stat(l.path)
+	var written int64
+	if l.file != nil {
+		written, _ = io.Copy(w, l.file)
+	}
+	if statErr != nil || (l.info != nil && os.SameFile(l.info, info)) {
+		return written
+	}
+	// the log was created or rotated, the new file is read from its start
+	l.Close()
+	l.file, l.info = nil, nil
+	file, err := os.Open(l.path)
+	if err != nil {
+		return written
+	}
+	if info, err = file.Stat(); err != nil {
+		file.Close()
+		return written
+	}
+	l.file, l.info = file, info
+	n, _ := io.Copy(w, l.file)
+	return written + n
+}
+
+func (l *followedLog) Close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// copyLogFile writes the content of a log file and returns the number of bytes written.
+// A missing file is treated as empty.
+func copyLogFile(w io.Writer, path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	n, _ := io.Copy(w, file)
+	return n
+}
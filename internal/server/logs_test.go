@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFollowedLogRotation appends to the log right before a rotation and writes more than
+// the old file to the new one before the next poll
+func TestFollowedLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	appendLog := func(lines ...string) {
+		t.Helper()
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		for _, line := range lines {
+			file.WriteString(line + "\n")
+		}
+	}
+	log := &followedLog{path: path}
+	defer log.Close()
+	var out bytes.Buffer
+
+	// the log does not exist before the first line
+	if n := log.copyTo(&out); n != 0 {
+		t.Fatalf("copied %d bytes of a missing log", n)
+	}
+	appendLog("old 1", "old 2")
+	log.copyTo(&out)
+	appendLog("old 3")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLog("new 1", "new 2", "new 3", "new 4", "new 5")
+	log.copyTo(&out)
+	appendLog("new 6")
+	log.copyTo(&out)
+
+	want := "old 1\nold 2\nold 3\nnew 1\nnew 2\nnew 3\nnew 4\nnew 5\nnew 6\n"
+	if out.String() != want {
+		t.Errorf("followed log %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mediaTypes are the content types of the files in the HLS and download roots, other
+// extensions are looked up with mime.TypeByExtension
+var mediaTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".opus": "audio/ogg",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".jpg":  "image/jpeg",
+	".vtt":  "text/vtt; charset=utf-8",
+}
+
+// maxPlaylistSize limits the playlists read into memory
+const maxPlaylistSize = 8 << 20
+
+const (
+	// a playlist is revalidated while ffmpeg is still appending segments to it
+	cacheGrowingPlaylist = "no-cache"
+	// a finished VOD playlist and the segments it lists do not change any more
+	cacheFinishedPlaylist = "public, max-age=3600"
+	cacheMediaFile        = "public, max-age=86400"
+)
+
+// MediaHandler serves the files below Root with byte range support. Hidden files and
+// folders, folders themselves and paths leading out of Root, also through symbolic links,
+// are answered with 404. With a Signer, requests need a signed URL and the URIs in
+// playlists are rewritten to carry the signature of the playlist.
+type MediaHandler struct {
+	Root   string
+	Signer *PlaybackSigner // nil to serve without signatures
+}
+
+func (h MediaHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.Signer != nil {
+		if err := h.Signer.Verify(req.URL.Path, req.URL.Query()); err != nil {
+			WriteHttpErrorMessage(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	filename, ok := h.resolve(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+
+	extension := strings.ToLower(filepath.Ext(filename))
+	contentType, ok := mediaTypes[extension]
+	if !ok {
+		contentType = mime.TypeByExtension(extension)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// large files outlive the write timeout of the server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if extension != ".m3u8" {
+		w.Header().Set("Cache-Control", cacheMediaFile)
+		http.ServeContent(w, req, stat.Name(), stat.ModTime(), file)
+		return
+	}
+
+	content, err := io.ReadAll(io.LimitReader(file, maxPlaylistSize))
+	if err != nil {
+		WriteHttpErrorMessage(w, "unable to read playlist", http.StatusInternalServerError)
+		return
+	}
+	// a playlist is finished once ffmpeg has written its end tag, the master playlist
+	// of a ladder never has one
+	if bytes.Contains(content, []byte("#EXT-X-ENDLIST")) {
+		w.Header().Set("Cache-Control", cacheFinishedPlaylist)
+	} else {
+		w.Header().Set("Cache-Control", cacheGrowingPlaylist)
+	}
+	if h.Signer != nil {
+		query := url.Values{}
+		query.Set("exp", req.URL.Query().Get("exp"))
+		query.Set("sig", req.URL.Query().Get("sig"))
+		content = rewritePlaylist(content, query.Encode())
+	}
+	http.ServeContent(w, req, stat.Name(), stat.ModTime(), bytes.NewReader(content))
+}
+
+// resolve maps the URL path to a file below Root
+func (h MediaHandler) resolve(urlPath string) (string, bool) {
+	if strings.ContainsRune(urlPath, 0) {
+		return "", false
+	}
+	cleaned := path.Clean("/" + urlPath)
+	for _, component := range strings.Split(cleaned, "/") {
+		if strings.HasPrefix(component, ".") {
+			return "", false
+		}
+	}
+	root, err := filepath.EvalSymlinks(h.Root)
+	if err != nil {
+		return "", false
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(cleaned)))
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+)
+
+// newMediaRoot creates a media root next to a secret file, with hidden files and symbolic
+// links pointing inside and outside of the root. Returns the root and the content of video.mp4.
+func newMediaRoot(t *testing.T) (string, []byte) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	video := make([]byte, 1000)
+	for i := range video {
+		video[i] = byte(i)
+	}
+	files := map[string][]byte{
+		"secret.txt":                []byte("secret"),
+		"root/video.mp4":            video,
+		"root/abc/stream.m3u8":      []byte("#EXTM3U\n#EXTINF:10.0,\nstream0.ts\n#EXT-X-ENDLIST\n"),
+		"root/.env":                 []byte("KEY=secret"),
+		"root/.hidden/segment.ts":   []byte("hidden"),
+		"root/folder/.keep":         nil,
+		"root/abc/subtitles.en.vtt": []byte("WEBVTT\n"),
+	}
+	for name, content := range files {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/outside":      base,
+		"root/leak.txt":     filepath.Join(base, "secret.txt"),
+		"root/relative.txt": "../secret.txt",
+		"root/inside.mp4":   filepath.Join(root, "video.mp4"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, video
+}
+
+func TestMediaHandlerPaths(t *testing.T) {
+	root, video := newMediaRoot(t)
+	handler := MediaHandler{Root: root}
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{"file", "/video.mp4", http.StatusOK},
+		{"playlist", "/abc/stream.m3u8", http.StatusOK},
+		{"symlink inside the root", "/inside.mp4", http.StatusOK},
+		{"parent", "/../secret.txt", http.StatusNotFound},
+		{"nested parent", "/abc/../../secret.txt", http.StatusNotFound},
+		{"encoded parent", "/%2e%2e/secret.txt", http.StatusNotFound},
+		{"encoded separators", "/abc/..%2f..%2fsecret.txt", http.StatusNotFound},
+		{"encoded backslash", "/..%5csecret.txt", http.StatusNotFound},
+		{"null byte", "/video.mp4%00.txt", http.StatusNotFound},
+		{"symlinked folder outside the root", "/outside/secret.txt", http.StatusNotFound},
+		{"symlinked file outside the root", "/leak.txt", http.StatusNotFound},
+		{"relative symlink outside the root", "/relative.txt", http.StatusNotFound},
+		{"dotfile", "/.env", http.StatusNotFound},
+		{"hidden folder", "/.hidden/segment.ts", http.StatusNotFound},
+		{"encoded dotfile", "/%2eenv", http.StatusNotFound},
+		{"folder", "/folder", http.StatusNotFound},
+		{"root", "/", http.StatusNotFound},
+		{"missing file", "/missing.mp4", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if recorder.Code != test.code {
+				t.Fatalf("GET %s answered %d, want %d", test.target, recorder.Code, test.code)
+			}
+			if bytes.Contains(recorder.Body.Bytes(), []byte("secret")) {
+				t.Errorf("GET %s leaked a file outside the root", test.target)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video.mp4", nil))
+	if !bytes.Equal(recorder.Body.Bytes(), video) || recorder.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("GET /video.mp4 served %d bytes of %q", recorder.Body.Len(), recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestMediaHandlerRange(t *testing.T) {
+	root, video := newMediaRoot(t)
+	server := httptest.NewServer(MediaHandler{Root: root})
+	defer server.Close()
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		code         int
+		contentRange string
+		body         []byte
+	}{
+		{"whole file", "", http.StatusOK, "", video},
+		{"first bytes", "bytes=0-99", http.StatusPartialContent, "bytes 0-99/1000", video[:100]},
+		{"middle", "bytes=500-509", http.StatusPartialContent, "bytes 500-509/1000", video[500:510]},
+		{"open end", "bytes=990-", http.StatusPartialContent, "bytes 990-999/1000", video[990:]},
+		{"suffix", "bytes=-10", http.StatusPartialContent, "bytes 990-999/1000", video[990:]},
+		{"end beyond the file", "bytes=995-2000", http.StatusPartialContent, "bytes 995-999/1000", video[995:]},
+		{"start beyond the file", "bytes=1000-", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+		{"malformed", "bytes=abc", http.StatusRequestedRangeNotSatisfiable, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/video.mp4", nil)
+			if test.rangeHeader != "" {
+				req.Header.Set("Range", test.rangeHeader)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != test.code {
+				t.Fatalf("Range %q answered %d, want %d", test.rangeHeader, resp.StatusCode, test.code)
+			}
+			if got := resp.Header.Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range %q, want %q", got, test.contentRange)
+			}
+			if test.body != nil && !bytes.Equal(body, test.body) {
+				t.Errorf("Range %q served %d bytes, want %d", test.rangeHeader, len(body), len(test.body))
+			}
+		})
+	}
+
+	// a playlist rewritten in memory supports ranges as well
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/abc/stream.m3u8", nil)
+	req.Header.Set("Range", "bytes=0-6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "#EXTM3U" {
+		t.Errorf("playlist range answered %d with %q", resp.StatusCode, body)
+	}
+}
+
+// TestMediaRoute requests traversals through the router, which cleans the path before
+// the prefix is stripped
+func TestMediaRoute(t *testing.T) {
+	root, _ := newMediaRoot(t)
+	s := &RequestHandler{Requests: make(map[string]Request), Config: &config.Config{}}
+	s.Config.Downloader.DownloadRoot = root
+	s.Config.Downloader.HLSRoot = root
+	server := httptest.NewServer(s.NewHTTPServer(config.ServerConfig{Addr: "127.0.0.1:0", ServeMedia: true}).Handler)
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for _, target := range []string{"/media/../secret.txt", "/media/%2e%2e/secret.txt", "/hls/abc/%2e%2e/%2e%2e/secret.txt",
+		"/media/outside/secret.txt", "/hls/.env"} {
+		resp, err := client.Get(server.URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK || bytes.Contains(body, []byte("secret")) {
+			t.Errorf("GET %s answered %d with %q", target, resp.StatusCode, body)
+		}
+	}
+	resp, err := client.Get(server.URL + "/media/video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /media/video.mp4 answered %d", resp.StatusCode)
+	}
+}
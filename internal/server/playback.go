@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+)
+
+var (
+	ErrPlaybackUnsigned = errors.New("the playback URL is not signed")
+	ErrPlaybackExpired  = errors.New("the playback URL has expired")
+	ErrPlaybackInvalid  = errors.New("the signature of the playback URL is invalid")
+)
+
+// playbackKeySize is the size of a generated signing key in bytes
+const playbackKeySize = 32
+
+// PlaybackSigner issues and checks expiring HMAC signatures of playback URLs. A signature
+// covers the folder of the signed file, so that the segments of a playlist and the variant
+// playlists of a ladder are accepted with the signature of the playlist.
+type PlaybackSigner struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+func NewPlaybackSigner(key []byte, ttl time.Duration) *PlaybackSigner {
+	return &PlaybackSigner{key: key, ttl: ttl, now: time.Now}
+}
+
+// LoadPlaybackKey reads the signing key from path. A random key is generated and saved
+// if the file does not exist yet.
+func LoadPlaybackKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < playbackKeySize {
+			return nil, fmt.Errorf("playback key %s is shorter than %d bytes", path, playbackKeySize)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read playback key %w", err)
+	}
+	key = make([]byte, playbackKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate playback key %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to save playback key %w", err)
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("unable to save playback key %w", err)
+	}
+	return key, nil
+}
+
+// Sign returns the escaped path below the HLS root with the expiry and signature appended
+func (p *PlaybackSigner) Sign(escapedPath string) string {
+	unescaped, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return escapedPath
+	}
+	expiry := p.now().Add(p.ttl).Unix()
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(expiry, 10))
+	query.Set("sig", p.signature(path.Dir(path.Clean("/"+unescaped)), expiry))
+	return escapedPath + "?" + query.Encode()
+}
+
+// Verify checks the signature in query for the unescaped path below the HLS root
+func (p *PlaybackSigner) Verify(unescapedPath string, query url.Values) error {
+	if query.Get("exp") == "" || query.Get("sig") == "" {
+		return ErrPlaybackUnsigned
+	}
+	expiry, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return ErrPlaybackInvalid
+	}
+	expected := p.signature(path.Dir(path.Clean("/"+unescapedPath)), expiry)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return ErrPlaybackInvalid
+	}
+	if p.now().Unix() > expiry {
+		return ErrPlaybackExpired
+	}
+	return nil
+}
+
+// signature computes the signature of a folder for the given expiry
+func (p *PlaybackSigner) signature(folder string, expiry int64) string {
+	mac := hmac.New(sha256.New, p.key)
+	fmt.Fprintf(mac, "%s\n%d", folder, expiry)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// playlistURI matches the URI attribute of tags such as #EXT-X-MAP and #EXT-X-MEDIA
+var playlistURI = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewritePlaylist appends the signature query to the relative URIs of a playlist, so that
+// segments and variant playlists inherit the signature of the playlist
+func rewritePlaylist(content []byte, query string) []byte {
+	var buffer bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+			line = playlistURI.ReplaceAllStringFunc(line, func(attribute string) string {
+				uri := strings.TrimSuffix(strings.TrimPrefix(attribute, `URI="`), `"`)
+				return `URI="` + withQuery(uri, query) + `"`
+			})
+		case strings.TrimSpace(line) != "":
+			line = withQuery(line, query)
+		}
+		buffer.WriteString(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// withQuery appends query to a URI relative to the playlist, other URIs are left unchanged
+func withQuery(uri string, query string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.IsAbs() || strings.HasPrefix(uri, "/") || parsed.RawQuery != "" {
+		return uri
+	}
+	return uri + "?" + query
+}
+
+// signSession replaces the playback URLs of the session by signed URLs. The session must not
+// be shared, such as a snapshot returned by the DownloadManager.
+func (s *RequestHandler) signSession(session *downloader.Session) *downloader.Session {
+	if s.Playback == nil || session == nil {
+		return session
+	}
+	for _, video := range session.Videos {
+		if video.StreamURL != "" {
+			video.StreamURL = s.Playback.Sign(video.StreamURL)
+		}
+		if video.CoverURL != "" {
+			video.CoverURL = s.Playback.Sign(video.CoverURL)
+		}
+	}
+	return session
+}
+
+// signSessions signs the playback URLs of all sessions, see signSession
+func (s *RequestHandler) signSessions(sessions []*downloader.Session) []*downloader.Session {
+	for _, session := range sessions {
+		s.signSession(session)
+	}
+	return sessions
+}
+
+// AuthorizePlayback lets nginx check a playback request with auth_request. The original
+// request URI, relative to the HLS root, is expected in the X-Original-URI header.
+func (s *RequestHandler) AuthorizePlayback(w http.ResponseWriter, req *http.Request) {
+	if s.Playback == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	original, err := url.ParseRequestURI(req.Header.Get("X-Original-URI"))
+	if err != nil {
+		WriteHttpErrorMessage(w, "missing or invalid X-Original-URI", http.StatusForbidden)
+		return
+	}
+	if err := s.Playback.Verify(original.Path, original.Query()); err != nil {
+		WriteHttpErrorMessage(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
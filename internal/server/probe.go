@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+)
+
+// ProbeURL runs yt-dlp in simulate mode on the URL given as FORM data or NewURLRequest and
+// returns its metadata and formats, so that a client can confirm the download before posting it to /new
+func (s *RequestHandler) ProbeURL(w http.ResponseWriter, req *http.Request) {
+	newRequest, err := readNewURLRequest(req)
+	if err != nil {
+		WriteHttpErrorMessage(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	myURL := newRequest.URL
+	if myURL == "" {
+		WriteHttpErrorMessage(w, "request cannot be empty", http.StatusBadRequest)
+		return
+	}
+	s.extendWriteDeadline(w)
+	result, err := s.DownloadManager.Probe(req.Context(), myURL)
+	if err != nil {
+		code, err := probeError(err)
+		WriteHttpErrorMessage(w, err.Error(), code)
+		return
+	}
+	WriteJSONMessage(w, result)
+}
+
+// validateURL probes the URL when the request asks for it with validate=true.
+// Returns the HTTP status to respond with and the error if the URL cannot be downloaded.
+func (s *RequestHandler) validateURL(w http.ResponseWriter, req *http.Request, newRequest NewURLRequest) (int, error) {
+	if !newRequest.Validate {
+		return http.StatusOK, nil
+	}
+	s.extendWriteDeadline(w)
+	if _, err := s.DownloadManager.Probe(req.Context(), newRequest.URL); err != nil {
+		return probeError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// extendWriteDeadline gives the response enough time for a probe, which may take longer
+// than the write timeout of the server
+func (s *RequestHandler) extendWriteDeadline(w http.ResponseWriter) {
+	if s.Config == nil {
+		return
+	}
+	deadline := time.Now().Add(s.Config.Server.WriteTimeout.Duration + s.Config.Downloader.ProbeTimeout.Duration)
+	http.NewResponseController(w).SetWriteDeadline(deadline)
+}
+
+// probeError maps a failed probe to the HTTP status and the error reported to the client
+func probeError(err error) (int, error) {
+	var toolErr *downloader.ToolError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, err
+	case errors.As(err, &toolErr) && toolErr.Code == downloader.ERRCODE_UNSUPPORTED_URL:
+		return http.StatusUnprocessableEntity, fmt.Errorf("%w: %s", ErrUnsupportedURL, toolErr.Message)
+	case errors.As(err, &toolErr) && !toolErr.Code.Retryable():
+		// the URL is understood but cannot be downloaded, e.g. a private video
+		return http.StatusUnprocessableEntity, toolErr
+	default:
+		return http.StatusBadGateway, err
+	}
+}
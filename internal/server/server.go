@@ -4,30 +4,67 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/internal/logging"
 	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
 	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
 )
 
-// Type RequestHandler associates a dictionary of requests with a DownloadManager
+// Type RequestHandler associates a dictionary of requests with a DownloadManager.
+// Requests is guarded by mu, the handler is safe for concurrent use.
 type RequestHandler struct {
+	mu              sync.RWMutex
 	Requests        map[string]Request
-	DownloadManager downloader.DownloadManager
+	DownloadManager *downloader.DownloadManager
+	Store           store.Store     // persists requests across restarts, may be nil
+	Config          *config.Config  // effective configuration reported by GET /config
+	Playback        *PlaybackSigner // signs playback URLs, nil to hand them out unsigned
+	Tokens          *TokenStore     // bearer tokens of the devices, nil to disable authentication
 }
 
+const storeKindRequests = "requests"
+
 // Type Request represents a received URL request
 type Request struct {
 	URL         string    // URL string
 	ReceiveTime time.Time // timestamp when the request was received
 	Status      string
+	Owners      []string `json:",omitempty"` // users sharing the request, empty without authentication
+}
+
+// NewURLRequest is the JSON body accepted by /new and /probe in place of FORM data
+type NewURLRequest struct {
+	URL      string                  `json:"url"`
+	Validate bool                    `json:"validate"` // probe the URL before queuing it
+	Options  downloader.SessionPatch `json:"options"`  // download options, checked against the allowlist of the server
+}
+
+// readNewURLRequest reads a JSON encoded NewURLRequest, or the url and validate FORM fields
+func readNewURLRequest(req *http.Request) (NewURLRequest, error) {
+	var newRequest NewURLRequest
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/json" {
+		decoder := json.NewDecoder(io.LimitReader(req.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&newRequest)
+		return newRequest, err
+	}
+	newRequest.URL = req.FormValue("url")
+	newRequest.Validate, _ = strconv.ParseBool(req.FormValue("validate"))
+	return newRequest, nil
 }
 
 type NewURLResponse struct {
@@ -41,20 +78,26 @@ var ErrEmptyRequestText = fmt.Errorf("requested URL cannot be empty")
 var ErrURLAlreadyExisted = fmt.Errorf("requested URL already existed")
 var ErrUnsupportedURL = fmt.Errorf("the provided URL is not supported by YT-DLP")
 
-// Insert adds new URL request to the queue
-func (s *RequestHandler) Insert(urlstring string) (string, error) {
-	fmt.Println("the received URL is: ", urlstring)
+// Insert adds new URL request of owner to the queue, "" if the request has no owner
+func (s *RequestHandler) Insert(urlstring string, owner string) (string, error) {
 	if urlstring != "" {
 		sha := helper.SHAFromString(urlstring)
+		s.mu.Lock()
 		_, ok := s.Requests[sha] // check if the request has been posted before
 		if !ok {
 			newRequest := Request{
 				ReceiveTime: time.Now(),
 				URL:         urlstring,
 			}
+			if owner != "" {
+				newRequest.Owners = []string{owner}
+			}
 			s.Requests[sha] = newRequest
+			s.mu.Unlock()
+			s.saveRequest(sha, newRequest)
 			return sha, nil
 		} else {
+			s.mu.Unlock()
 			return "", ErrURLAlreadyExisted
 		}
 	} else {
@@ -64,7 +107,9 @@ func (s *RequestHandler) Insert(urlstring string) (string, error) {
 
 // Retrieve a Request from provided SHA hash
 func (s *RequestHandler) Retrieve(sha string) (*Request, error) {
+	s.mu.RLock()
 	request, ok := s.Requests[sha]
+	s.mu.RUnlock()
 	if !ok {
 		return nil, ErrIDNotFound
 	} else {
@@ -72,6 +117,54 @@ func (s *RequestHandler) Retrieve(sha string) (*Request, error) {
 	}
 }
 
+// saveRequest writes a request to the state store
+func (s *RequestHandler) saveRequest(sha string, request Request) {
+	if s.Store == nil {
+		return
+	}
+	if err := s.Store.Put(storeKindRequests, sha, request); err != nil {
+		slog.Error("unable to persist request", "request", sha, "error", err)
+	}
+}
+
+// removeRequest deletes a request from memory and from the state store
+func (s *RequestHandler) removeRequest(sha string) {
+	s.mu.Lock()
+	delete(s.Requests, sha)
+	s.mu.Unlock()
+	if s.Store == nil {
+		return
+	}
+	if err := s.Store.Delete(storeKindRequests, sha); err != nil {
+		slog.Error("unable to remove request from store", "request", sha, "error", err)
+	}
+}
+
+// Restore loads all requests saved in the state store
+func (s *RequestHandler) Restore() error {
+	if s.Store == nil {
+		return nil
+	}
+	return s.Store.Load(storeKindRequests, func(key string, data []byte) error {
+		var request Request
+		if err := json.Unmarshal(data, &request); err != nil {
+			slog.Warn("skipping unreadable request record", "request", key)
+			return nil
+		}
+		s.mu.Lock()
+		s.Requests[key] = request
+		s.mu.Unlock()
+		return nil
+	})
+}
+
+// count returns the number of registered requests
+func (s *RequestHandler) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Requests)
+}
+
 func HealthCheckHandler(w http.ResponseWriter, req *http.Request) {
 	WriteJSONMessage(w, `{"alive": true}`)
 	// w.Header().Set("Content-Type", "application/json")
@@ -79,24 +172,66 @@ func HealthCheckHandler(w http.ResponseWriter, req *http.Request) {
 	// io.WriteString(w, `{"alive": true}`)
 }
 
+// GetConfig reports the effective configuration of the server
+func (s *RequestHandler) GetConfig(w http.ResponseWriter, req *http.Request) {
+	if s.Config == nil {
+		WriteHttpErrorMessage(w, "configuration not available", http.StatusNotFound)
+		return
+	}
+	WriteJSONMessage(w, s.Config)
+}
+
+type logLevelMessage struct {
+	Level string `json:"level"`
+}
+
+// HandleLogLevel reports or changes the minimum level of log records. A PUT request
+// expects a body such as {"level": "debug"}.
+func (s *RequestHandler) HandleLogLevel(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "PUT" {
+		var message logLevelMessage
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<10)).Decode(&message); err != nil {
+			WriteHttpErrorMessage(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := logging.ParseLevel(message.Level)
+		if err != nil {
+			WriteHttpErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Level.Set(level)
+		slog.Info("log level changed", "level", level.String())
+	}
+	WriteJSONMessage(w, logLevelMessage{Level: strings.ToLower(logging.Level.Level().String())})
+}
+
+// GetAllDownloads reports the sessions of the caller, all sessions for admins
 func (s *RequestHandler) GetAllDownloads(w http.ResponseWriter, req *http.Request) {
-	WriteJSONMessage(w, s.DownloadManager.SessionsInfo)
+	WriteJSONMessage(w, s.signSessions(visibleSessions(req, s.DownloadManager.Sessions())))
 }
 
 func (s *RequestHandler) HandleSingleDownload(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	shaKey := vars["id"]
 	request, err := s.Retrieve(shaKey)
-	if err != nil {
-		// ID does not exist
+	if err != nil || !s.canAccess(req, shaKey) {
+		// ID does not exist, or belongs to other users
 		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
 	} else {
 		switch req.Method {
 		case "GET":
 			WriteJSONMessage(w, request)
-		case "UPDATE":
-			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		case "PATCH", "UPDATE":
+			s.UpdateDownload(w, req, shaKey)
 		case "DELETE":
+			if owner, all := requestOwner(req); !all && s.unshare(shaKey, owner) {
+				// other users keep the download
+				if err := s.DownloadManager.RemoveOwner(shaKey, owner); err != nil {
+					slog.Warn("unable to remove owner", "session", shaKey, "owner", owner, "error", err)
+				}
+				WriteJSONMessage(w, `{"deletion": true}`)
+				return
+			}
 			if s.DownloadManager.CancelDownload(shaKey) {
 				WriteJSONMessage(w, `{"deletion": true}`)
 				// w.Header().Set("Content-Type", "application/json")
@@ -108,41 +243,173 @@ func (s *RequestHandler) HandleSingleDownload(w http.ResponseWriter, req *http.R
 				// w.WriteHeader(http.StatusInternalServerError)
 				// io.WriteString(w, `{"deletion": false}`)
 			}
-			delete(s.Requests, shaKey)
+			s.removeRequest(shaKey)
 		default:
 			http.Error(w, "Not Implemented", http.StatusNotImplemented)
 		}
 	}
 }
 
+// UpdateDownload changes the options of a session from a JSON encoded SessionPatch.
+// Settings affecting the download are only accepted while the session is queued or paused.
+func (s *RequestHandler) UpdateDownload(w http.ResponseWriter, req *http.Request, shaKey string) {
+	var patch downloader.SessionPatch
+	decoder := json.NewDecoder(io.LimitReader(req.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		WriteHttpErrorMessage(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, err := s.DownloadManager.UpdateSession(shaKey, patch)
+	switch {
+	case errors.Is(err, downloader.ErrInvalidOption):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, downloader.ErrOptionLocked):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, downloader.ErrSessionNotFound) || (err == nil && session == nil):
+		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
+	case err != nil:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInternalServerError)
+	default:
+		WriteJSONMessage(w, s.signSession(session))
+	}
+}
+
+// PauseDownload stops a running download, keeping partially downloaded files
+func (s *RequestHandler) PauseDownload(w http.ResponseWriter, req *http.Request) {
+	shaKey := mux.Vars(req)["id"]
+	if !s.canAccess(req, shaKey) {
+		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
+		return
+	}
+	s.writeControlResult(w, shaKey, s.DownloadManager.PauseDownload(shaKey))
+}
+
+// ResumeDownload restarts a paused download
+func (s *RequestHandler) ResumeDownload(w http.ResponseWriter, req *http.Request) {
+	shaKey := mux.Vars(req)["id"]
+	if !s.canAccess(req, shaKey) {
+		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
+		return
+	}
+	s.writeControlResult(w, shaKey, s.DownloadManager.ResumeDownload(shaKey))
+}
+
+// writeControlResult responds with the session after a pause or resume request
+func (s *RequestHandler) writeControlResult(w http.ResponseWriter, shaKey string, err error) {
+	switch {
+	case errors.Is(err, downloader.ErrSessionNotFound):
+		WriteHttpErrorMessage(w, shaKey+" does not exist", http.StatusNotFound)
+	case errors.Is(err, downloader.ErrShuttingDown):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, downloader.ErrQuotaExceeded):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusConflict)
+	default:
+		if session := s.DownloadManager.Session(shaKey); session != nil {
+			WriteJSONMessage(w, s.signSession(session))
+		} else {
+			// the download was still queued and has no session yet
+			WriteJSONMessage(w, map[string]string{"id": shaKey})
+		}
+	}
+}
+
 // Handles new URL request sent with POST method. The server expects the URL to be provided
 // as FORM data
 func (s *RequestHandler) NewURLHandler(w http.ResponseWriter, req *http.Request) {
-	myURL := req.FormValue("url")
+	newRequest, err := readNewURLRequest(req)
+	if err != nil {
+		WriteHttpErrorMessage(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	myURL := newRequest.URL
 	decodedValue, err := url.QueryUnescape(myURL)
 	if err == nil {
-		fmt.Println("Received POST request with text: ", decodedValue)
+		slog.Debug("received new URL", "url", decodedValue)
 	}
+	options, optionsErr := s.DownloadManager.NewOptions(newRequest.Options)
+	owner, _ := requestOwner(req)
 	if myURL == "" {
 		WriteHttpErrorMessage(w, "request cannot be empty", http.StatusBadRequest)
+	} else if optionsErr != nil {
+		WriteHttpErrorMessage(w, optionsErr.Error(), http.StatusBadRequest)
+	} else if s.DownloadManager.IsShuttingDown() {
+		WriteHttpErrorMessage(w, downloader.ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+	} else if code, err := s.validateURL(w, req, newRequest); err != nil {
+		WriteHttpErrorMessage(w, err.Error(), code)
 	} else {
-		if newSHA, err := s.Insert(myURL); err != nil {
+		if newSHA, err := s.Insert(myURL, owner); err != nil {
+			sha := helper.SHAFromString(myURL)
+			shared := errors.Is(err, ErrURLAlreadyExisted) && s.share(sha, owner)
+			if shared {
+				// another user requested the URL before, its media is shared rather than downloaded twice
+				if err := s.DownloadManager.AddOwner(sha, owner); err != nil {
+					slog.Warn("unable to share session", "session", sha, "owner", owner, "error", err)
+				}
+				slog.Info("request shared", "url", myURL, "session", sha, "owner", owner)
+			}
+			if errors.Is(err, ErrURLAlreadyExisted) && s.DownloadManager.IsResumable(sha) {
+				// the request was interrupted by a restart, posting it again resumes the download
+				if err := s.DownloadManager.NewDownload(sha, myURL, options, owner); errors.Is(err, downloader.ErrQuotaExceeded) {
+					WriteHttpErrorMessage(w, err.Error(), http.StatusInsufficientStorage)
+					return
+				} else if err != nil {
+					WriteHttpErrorMessage(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+				WriteJSONMessage(w, NewURLResponse{URL: myURL, ShaKey: sha, TotalDownloads: s.count()})
+				return
+			}
+			if shared {
+				WriteJSONMessage(w, NewURLResponse{URL: myURL, ShaKey: sha, TotalDownloads: s.count()})
+				return
+			}
+			if errors.Is(err, ErrURLAlreadyExisted) && s.DownloadManager.FindDownloader(sha) == nil {
+				// the download of an earlier post could not be started, it is started again
+				if s.startRequest(w, sha, myURL, options, owner) {
+					WriteJSONMessage(w, NewURLResponse{URL: myURL, ShaKey: sha, TotalDownloads: s.count()})
+				}
+				return
+			}
 			WriteHttpErrorMessage(w, "unable to create a new request", http.StatusInternalServerError)
-		} else {
+		} else if s.startRequest(w, newSHA, myURL, options, owner) {
 			newResponse := NewURLResponse{
 				URL:            myURL,
 				ShaKey:         newSHA,
-				TotalDownloads: len(s.Requests),
+				TotalDownloads: s.count(),
 			}
 			WriteJSONMessage(w, newResponse)
-			fmt.Fprintf(os.Stdout, "A new request for (%s) has been registered and the SHA of the link is %s\n", myURL, newSHA)
-			fmt.Printf("Total activities so far: %d\n", len(s.Requests))
-			s.DownloadManager.NewDownload(newSHA, myURL)
-
+			slog.Info("new request registered", "url", myURL, "session", newSHA, "total", s.count())
 		}
 	}
 }
 
+// startRequest starts the download of a registered request. If it cannot be started the
+// request is removed again, so that posting the URL later is not refused, and an error is
+// written to w.
+func (s *RequestHandler) startRequest(w http.ResponseWriter, sha string, urlstring string,
+	options downloader.SessionOptions, owner string) bool {
+	err := s.DownloadManager.NewDownload(sha, urlstring, options, owner)
+	if err == nil {
+		return true
+	}
+	s.removeRequest(sha)
+	slog.Warn("new request not started", "session", sha, "error", err)
+	switch {
+	case errors.Is(err, downloader.ErrShuttingDown):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, downloader.ErrInvalidURL):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, downloader.ErrQuotaExceeded):
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		WriteHttpErrorMessage(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
 // Helper function for writting an error message to HTTP response
 func WriteHttpErrorMessage(w http.ResponseWriter, errText string, code int) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -152,6 +419,12 @@ func WriteHttpErrorMessage(w http.ResponseWriter, errText string, code int) {
 
 // Helper function for encoding a response in JSON and set the proper header
 func WriteJSONMessage(w http.ResponseWriter, v any) {
+	WriteJSONStatus(w, v, http.StatusOK)
+}
+
+// WriteJSONStatus encodes a response in JSON and sends it with the status code. The status
+// is only written once the response is encoded, so that a failure can still be reported.
+func WriteJSONStatus(w http.ResponseWriter, v any, code int) {
 	var buffer bytes.Buffer
 	encoder := json.NewEncoder(&buffer)
 	if err := encoder.Encode(v); err != nil {
@@ -159,27 +432,58 @@ func WriteJSONMessage(w http.ResponseWriter, v any) {
 		WriteHttpErrorMessage(w, "Failed to encode JSON data", http.StatusInternalServerError)
 	} else {
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
 		w.Write(buffer.Bytes())
 	}
 }
 
 // Creates a new HTTP Server
-func (s *RequestHandler) NewHTTPServer(addr string) *http.Server {
+func (s *RequestHandler) NewHTTPServer(cfg config.ServerConfig) *http.Server {
+	addr := cfg.Addr
 	parts := strings.Split(addr, ":")
 	if len(parts) < 2 || parts[0] == "" || (parts[0] != "localhost" && parts[0] != "127.0.0.1") {
-		fmt.Println("Will bind to all addresses!")
+		slog.Warn("binding to all addresses", "addr", addr)
+		if s.Tokens == nil && cfg.TLSClientCAFile == "" {
+			slog.Warn("authentication is disabled, anyone on the network can manage downloads")
+		}
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/new", s.NewURLHandler).Methods("POST")
+	r.HandleFunc("/probe", s.ProbeURL).Methods("POST")
 	r.HandleFunc("/urls", s.GetAllDownloads).Methods("GET")
-	r.HandleFunc("/urls/{id}", s.HandleSingleDownload).Methods("GET", "UPDATE", "DELETE")
-	r.HandleFunc("/", HealthCheckHandler).Methods("GET")
+	r.HandleFunc("/events", s.StreamEvents).Methods("GET")
+	r.HandleFunc("/urls/{id}", s.HandleSingleDownload).Methods("GET", "PATCH", "UPDATE", "DELETE")
+	r.HandleFunc("/urls/{id}/pause", s.PauseDownload).Methods("POST")
+	r.HandleFunc("/urls/{id}/resume", s.ResumeDownload).Methods("POST")
+	r.HandleFunc("/urls/{id}/log", s.GetSessionLog).Methods("GET")
+	r.HandleFunc("/config", s.GetConfig).Methods("GET").Name(routeAdmin + "config")
+	r.HandleFunc("/config/log-level", s.HandleLogLevel).Methods("GET", "PUT").Name(routeAdmin + "log-level")
+	if cfg.ServeMedia && s.Config != nil {
+		// a home install needs no separate web server for playback
+		r.PathPrefix("/hls/").Handler(http.StripPrefix("/hls",
+			MediaHandler{Root: s.Config.Downloader.HLSRoot, Signer: s.Playback})).Methods("GET", "HEAD").Name(routePlayback + "hls")
+		// no playback URL points into the download root, so its files stay behind the
+		// authentication of the API rather than a signature
+		r.PathPrefix("/media/").Handler(http.StripPrefix("/media",
+			MediaHandler{Root: s.Config.Downloader.DownloadRoot})).Methods("GET", "HEAD")
+	}
+	r.HandleFunc("/playback/auth", s.AuthorizePlayback).Methods("GET").Name(routePublic + "playback-auth")
+	r.HandleFunc("/", HealthCheckHandler).Methods("GET").Name(routePublic + "health")
+	if s.Tokens != nil {
+		r.HandleFunc("/tokens", s.CreateToken).Methods("POST").Name(routeAdmin + "create-token")
+		r.HandleFunc("/tokens", s.ListTokens).Methods("GET").Name(routeAdmin + "list-tokens")
+		r.HandleFunc("/tokens/{id}", s.RevokeToken).Methods("DELETE").Name(routeAdmin + "revoke-token")
+	}
+	if s.Tokens != nil || cfg.TLSClientCAFile != "" {
+		r.Use(s.Authenticate)
+	}
 
 	NewServer := &http.Server{
 		Addr:         addr,
 		Handler:      r,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
 	}
 	return NewServer
 }
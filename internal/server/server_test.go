@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// newTestHandler returns a RequestHandler whose downloads are replayed by runner
+func newTestHandler(t *testing.T, runner *downloader.FakeRunner) *RequestHandler {
+	t.Helper()
+	cfg := downloader.DefaultConfig()
+	cfg.DownloadRoot = t.TempDir()
+	cfg.HLSRoot = t.TempDir()
+	cfg.SessionLogDir = ""
+	cfg.StallTimeout.Duration = 0
+	dm := downloader.NewDownloadManager(cfg, store.NopStore{}, runner)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dm.Shutdown(ctx)
+	})
+	return &RequestHandler{Requests: make(map[string]Request), DownloadManager: dm}
+}
+
+// newTestServer serves the routes of s
+func newTestServer(t *testing.T, s *RequestHandler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(s.NewHTTPServer(config.ServerConfig{Addr: "127.0.0.1:0"}).Handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestConcurrentRequests posts, lists and deletes the same URLs from many goroutines,
+// it is meant to be run with -race
+func TestConcurrentRequests(t *testing.T) {
+	runner := downloader.NewFakeRunner()
+	runner.Record(downloader.TOOL_YTDLP, downloader.FakeRecording{
+		Stdout: strings.Repeat("[download] Destination: /tmp/video.mp4\n", 50),
+		Delay:  time.Millisecond,
+	})
+	s := newTestHandler(t, runner)
+	server := newTestServer(t, s)
+
+	urls := make([]string, 4)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://example.com/watch?v=%d", i)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 6; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				link := urls[(worker+i)%len(urls)]
+				switch (worker + i) % 3 {
+				case 0:
+					resp, err := http.PostForm(server.URL+"/new", url.Values{"url": {link}})
+					if err != nil {
+						t.Errorf("POST /new: %v", err)
+						return
+					}
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusInternalServerError {
+						t.Errorf("POST /new: unexpected status %d", resp.StatusCode)
+					}
+				case 1:
+					resp, err := http.Get(server.URL + "/urls")
+					if err != nil {
+						t.Errorf("GET /urls: %v", err)
+						return
+					}
+					var sessions []downloader.Session
+					if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+						t.Errorf("GET /urls: %v", err)
+					}
+					resp.Body.Close()
+				case 2:
+					req, _ := http.NewRequest(http.MethodDelete, server.URL+"/urls/"+helper.SHAFromString(link), nil)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Errorf("DELETE /urls/{id}: %v", err)
+						return
+					}
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+						t.Errorf("DELETE /urls/{id}: unexpected status %d", resp.StatusCode)
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// every request left has a session and the other way round
+	for _, link := range urls {
+		sha := helper.SHAFromString(link)
+		_, err := s.Retrieve(sha)
+		if hasRequest, hasSession := err == nil, s.DownloadManager.Session(sha) != nil; hasRequest != hasSession {
+			t.Errorf("request of %s registered: %v, session registered: %v", link, hasRequest, hasSession)
+		}
+	}
+}
+
+func TestNewURLJSONBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"url", "application/json", `{"url": "https://example.com/watch?v=1"}`, http.StatusOK},
+		{"options", "application/json; charset=utf-8",
+			`{"url": "https://example.com/watch?v=2", "options": {"maxResolution": 720, "videoCodec": "h264", "subtitles": ["en"], "container": "mp4"}}`,
+			http.StatusOK},
+		{"audio only", "application/json", `{"url": "https://example.com/watch?v=3", "options": {"audioOnly": true}}`, http.StatusOK},
+		{"form", "application/x-www-form-urlencoded", "url=" + url.QueryEscape("https://example.com/watch?v=4"), http.StatusOK},
+		{"unknown field", "application/json", `{"url": "https://example.com/watch?v=5", "priority": 3}`, http.StatusBadRequest},
+		{"unknown option", "application/json", `{"url": "https://example.com/watch?v=6", "options": {"exec": "rm -rf /"}}`, http.StatusBadRequest},
+		{"rejected option", "application/json", `{"url": "https://example.com/watch?v=7", "options": {"container": "avi"}}`, http.StatusBadRequest},
+		{"wrong type", "application/json", `{"url": "https://example.com/watch?v=8", "validate": "yes"}`, http.StatusBadRequest},
+		{"malformed", "application/json", `{"url": "https://example.com/watch?v=9"`, http.StatusBadRequest},
+		{"missing url", "application/json", `{"options": {"audioOnly": true}}`, http.StatusBadRequest},
+	}
+	s := newTestHandler(t, downloader.NewFakeRunner())
+	server := newTestServer(t, s)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+"/new", test.contentType, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("POST /new: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.code {
+				t.Fatalf("POST /new answered %d, want %d", resp.StatusCode, test.code)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			var response NewURLResponse
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("decoding the response: %v", err)
+			}
+			if s.DownloadManager.Session(response.ShaKey) == nil {
+				t.Errorf("no session for %s", response.URL)
+			}
+		})
+	}
+
+	// the options of the JSON body are applied to the session
+	session := s.DownloadManager.Session(helper.SHAFromString("https://example.com/watch?v=2"))
+	if options := session.Options; options.MaxResolution != 720 || options.VideoCodec != "h264" || options.Container != "mp4" ||
+		len(options.Subtitles) != 1 || options.Subtitles[0] != "en" {
+		t.Errorf("session options %+v do not match the request", options)
+	}
+	if s.count() != 4 {
+		t.Errorf("%d requests registered, want the 4 accepted ones", s.count())
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+)
+
+// TLSReloader holds the certificate of the server and the CAs of client certificates.
+// Both are read again by Reload, connections opened afterwards use the new files.
+type TLSReloader struct {
+	mu           sync.RWMutex
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	config       *tls.Config
+}
+
+// NewTLSReloader loads the files named in cfg
+func NewTLSReloader(cfg config.ServerConfig) (*TLSReloader, error) {
+	r := &TLSReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile, clientCAFile: cfg.TLSClientCAFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate, its key and the client CAs. The previous files stay in
+// use if any of them cannot be loaded.
+func (r *TLSReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read client CAs %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", r.clientCAFile)
+		}
+		// clients without a certificate, such as media players, may still use a token
+		// or a signed URL
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	r.mu.Lock()
+	r.config = tlsConfig
+	r.mu.Unlock()
+	return nil
+}
+
+// TLSConfig returns the configuration of the server, it picks up the files of the last Reload
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// certificateDevice returns the device of a verified client certificate, named after the
+// common name of the certificate. Without device tokens a certificate grants the full
+// access of a server without authentication.
+func certificateDevice(req *http.Request, admin bool) (DeviceToken, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return DeviceToken{}, false
+	}
+	certificate := req.TLS.VerifiedChains[0][0]
+	if certificate.Subject.CommonName == "" {
+		return DeviceToken{}, false
+	}
+	return DeviceToken{
+		ID:      "cert:" + hex.EncodeToString(certificate.SerialNumber.Bytes()),
+		Device:  certificate.Subject.CommonName,
+		Admin:   admin,
+		Created: certificate.NotBefore,
+	}, true
+}
+
+// NewRedirectServer returns a plain HTTP server listening on cfg.RedirectAddr which
+// redirects every request to the HTTPS address of the server
+func NewRedirectServer(cfg config.ServerConfig) *http.Server {
+	_, httpsPort, _ := net.SplitHostPort(cfg.Addr)
+	return &http.Server{
+		Addr:         cfg.RedirectAddr,
+		Handler:      RedirectHandler{Port: httpsPort},
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
+}
+
+// RedirectHandler redirects requests to the same host and path over HTTPS on Port.
+// The method and body are kept by a permanent redirect.
+type RedirectHandler struct {
+	Port string
+}
+
+func (h RedirectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Host == "" {
+		WriteHttpErrorMessage(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		// the Host header has no port
+		host = strings.Trim(req.Host, "[]")
+	}
+	if h.Port != "" && h.Port != "443" {
+		host = net.JoinHostPort(host, h.Port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target := "https://" + host + req.URL.RequestURI()
+	http.Redirect(w, req, target, http.StatusPermanentRedirect)
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+)
+
+// testCertificate is a certificate generated for a test with its key
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate for commonName signed by parent, or a
+// self-signed CA if parent is nil
+func newTestCertificate(t *testing.T, commonName string, serial int64, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour).Truncate(time.Second),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		issuer, signer = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTLSFiles writes the certificate and key of the server and the client CA into dir
+func writeTLSFiles(t *testing.T, dir string, server, ca *testCertificate) config.ServerConfig {
+	t.Helper()
+	cfg := config.ServerConfig{
+		Addr:            "127.0.0.1:0",
+		TLSCertFile:     filepath.Join(dir, "server.crt"),
+		TLSKeyFile:      filepath.Join(dir, "server.key"),
+		TLSClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	files := map[string][]byte{cfg.TLSCertFile: server.certPEM, cfg.TLSKeyFile: server.keyPEM, cfg.TLSClientCAFile: ca.certPEM}
+	for name, content := range files {
+		if err := os.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+// servedSerial returns the serial number of the certificate the reloader hands out
+func servedSerial(t *testing.T, r *TLSReloader) int64 {
+	t.Helper()
+	tlsConfig, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate.SerialNumber.Int64()
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "StreamSaver CA", 1, nil)
+	cfg := writeTLSFiles(t, dir, newTestCertificate(t, "localhost", 10, ca), ca)
+	reloader, err := NewTLSReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := servedSerial(t, reloader); serial != 10 {
+		t.Fatalf("serving certificate %d, want 10", serial)
+	}
+	tlsConfig, _ := reloader.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil {
+		t.Errorf("client certificates are not verified: %v", tlsConfig.ClientAuth)
+	}
+
+	// a renewed certificate is served after the reload
+	writeTLSFiles(t, dir, newTestCertificate(t, "localhost", 11, ca), ca)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := servedSerial(t, reloader); serial != 11 {
+		t.Errorf("serving certificate %d after the reload, want 11", serial)
+	}
+
+	// files which cannot be loaded leave the previous certificate in use
+	if err := os.WriteFile(cfg.TLSKeyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("reload of a broken key succeeded")
+	}
+	writeTLSFiles(t, dir, newTestCertificate(t, "localhost", 12, ca), ca)
+	if err := os.WriteFile(cfg.TLSClientCAFile, []byte("no certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("reload without client CAs succeeded")
+	}
+	if serial := servedSerial(t, reloader); serial != 11 {
+		t.Errorf("serving certificate %d after failed reloads, want 11", serial)
+	}
+}
+
+func TestCertificateDevice(t *testing.T) {
+	ca := newTestCertificate(t, "StreamSaver CA", 1, nil)
+	client := newTestCertificate(t, "iPad", 0xbeef, ca)
+	anonymous := newTestCertificate(t, "", 0xcafe, ca)
+	verified := func(certificate *testCertificate) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://localhost/urls", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate.certificate, ca.certificate}}}
+		return req
+	}
+
+	device, ok := certificateDevice(verified(client), false)
+	if !ok || device.ID != "cert:beef" || device.Device != "iPad" || device.Admin || !device.Created.Equal(client.certificate.NotBefore) {
+		t.Errorf("certificate maps to %+v (%v)", device, ok)
+	}
+	if device, _ := certificateDevice(verified(client), true); !device.Admin {
+		t.Error("certificate without device tokens is not an admin")
+	}
+	if _, ok := certificateDevice(verified(anonymous), true); ok {
+		t.Error("certificate without a common name is accepted")
+	}
+
+	// a certificate which was presented but not verified is not a device
+	unverified := httptest.NewRequest(http.MethodGet, "https://localhost/urls", nil)
+	unverified.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.certificate}}
+	for _, req := range []*http.Request{unverified, httptest.NewRequest(http.MethodGet, "/urls", nil)} {
+		if _, ok := certificateDevice(req, true); ok {
+			t.Errorf("request without a verified chain is accepted: %+v", req.TLS)
+		}
+	}
+}
+
+// TestClientCertificateHandshake connects with and without a client certificate to a
+// server using the reloader
+func TestClientCertificateHandshake(t *testing.T) {
+	ca := newTestCertificate(t, "StreamSaver CA", 1, nil)
+	cfg := writeTLSFiles(t, t.TempDir(), newTestCertificate(t, "localhost", 10, ca), ca)
+	reloader, err := NewTLSReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		device, _ := certificateDevice(req, false)
+		devices <- device.Device
+	}))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	client := newTestCertificate(t, "iPad", 20, ca)
+	stranger := newTestCertificate(t, "iPad", 30, newTestCertificate(t, "Other CA", 2, nil))
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		device       string
+	}{
+		{"without a certificate", nil, ""},
+		{"with a certificate", []tls.Certificate{{Certificate: [][]byte{client.certificate.Raw}, PrivateKey: client.key}}, "iPad"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certificates}}
+			defer transport.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if device := <-devices; device != test.device {
+				t.Errorf("request made by device %q, want %q", device, test.device)
+			}
+		})
+	}
+
+	// a certificate of another CA fails the handshake, it is sent although the server
+	// does not ask for its CA
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{stranger.certificate.Raw}, PrivateKey: stranger.key}, nil
+		}}}
+	defer transport.CloseIdleConnections()
+	if resp, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("certificate of an unknown CA is accepted")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   string
+		host   string
+		target string
+		want   string
+	}{
+		{"host with port", "443", "example.com:80", "/urls?id=1", "https://example.com/urls?id=1"},
+		{"bare host", "443", "example.com", "/", "https://example.com/"},
+		{"empty port", "", "example.com:8080", "/urls", "https://example.com/urls"},
+		{"other port", "8443", "example.com:8080", "/hls/abc/stream.m3u8", "https://example.com:8443/hls/abc/stream.m3u8"},
+		{"bare host on other port", "8443", "example.com", "/", "https://example.com:8443/"},
+		{"IPv4", "8443", "192.168.1.2:8080", "/", "https://192.168.1.2:8443/"},
+		{"IPv6 with port", "443", "[::1]:8080", "/urls", "https://[::1]/urls"},
+		{"bare IPv6", "443", "[fe80::1]", "/", "https://[fe80::1]/"},
+		{"IPv6 on other port", "8443", "[::1]:8080", "/urls", "https://[::1]:8443/urls"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://placeholder"+test.target, nil)
+			req.Host = test.host
+			recorder := httptest.NewRecorder()
+			RedirectHandler{Port: test.port}.ServeHTTP(recorder, req)
+			if recorder.Code != http.StatusPermanentRedirect {
+				t.Fatalf("redirect answered %d, want %d", recorder.Code, http.StatusPermanentRedirect)
+			}
+			if location := recorder.Header().Get("Location"); location != test.want {
+				t.Errorf("redirected to %q, want %q", location, test.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = ""
+	recorder := httptest.NewRecorder()
+	RedirectHandler{Port: "443"}.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("request without a host answered %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
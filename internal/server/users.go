@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+)
+
+// requestOwner returns the user a request acts for and whether it may access the downloads
+// of every user, which is the case for admin tokens and without authentication
+func requestOwner(req *http.Request) (string, bool) {
+	device, ok := requestDevice(req)
+	if !ok {
+		return "", true
+	}
+	return device.Owner(), device.Admin
+}
+
+// isVisibleTo reports whether a user may access the request. Requests without owners
+// were posted without authentication and are visible to everyone.
+func (r Request) isVisibleTo(owner string) bool {
+	return len(r.Owners) == 0 || slices.Contains(r.Owners, owner)
+}
+
+// canAccess reports whether the caller may access the request of sha
+func (s *RequestHandler) canAccess(req *http.Request, sha string) bool {
+	owner, all := requestOwner(req)
+	if all {
+		return true
+	}
+	request, err := s.Retrieve(sha)
+	return err == nil && request.isVisibleTo(owner)
+}
+
+// share adds owner to the request of sha. Returns false if the owner is empty or already
+// listed, the request is left alone in that case.
+func (s *RequestHandler) share(sha string, owner string) bool {
+	s.mu.Lock()
+	request, ok := s.Requests[sha]
+	if !ok || owner == "" || slices.Contains(request.Owners, owner) {
+		s.mu.Unlock()
+		return false
+	}
+	request.Owners = append(slices.Clip(request.Owners), owner)
+	s.Requests[sha] = request
+	s.mu.Unlock()
+	s.saveRequest(sha, request)
+	return true
+}
+
+// unshare removes owner from the request of sha. Returns false if other users do not share
+// the request, in which case it is left alone and the caller removes it altogether.
+func (s *RequestHandler) unshare(sha string, owner string) bool {
+	s.mu.Lock()
+	request, ok := s.Requests[sha]
+	if !ok || !slices.Contains(request.Owners, owner) || len(request.Owners) < 2 {
+		s.mu.Unlock()
+		return false
+	}
+	request.Owners = slices.DeleteFunc(slices.Clone(request.Owners), func(o string) bool { return o == owner })
+	s.Requests[sha] = request
+	s.mu.Unlock()
+	s.saveRequest(sha, request)
+	return true
+}
+
+// visibleSessions keeps the sessions the caller may access
+func visibleSessions(req *http.Request, sessions []*downloader.Session) []*downloader.Session {
+	owner, all := requestOwner(req)
+	if all {
+		return sessions
+	}
+	visible := make([]*downloader.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if session.IsVisibleTo(owner) {
+			visible = append(visible, session)
+		}
+	}
+	return visible
+}
+
+// eventFilter drops the events of sessions a user may not access. A session which stops
+// being visible, because the user removed their share, is reported as removed.
+type eventFilter struct {
+	owner string
+	all   bool
+	seen  map[string]bool // sessions reported to the user so far
+}
+
+func newEventFilter(req *http.Request) *eventFilter {
+	owner, all := requestOwner(req)
+	return &eventFilter{owner: owner, all: all, seen: make(map[string]bool)}
+}
+
+// filter returns the event to send, false if nothing is sent. The sessions of the event
+// are shared by all subscribers and are not modified.
+func (f *eventFilter) filter(event downloader.SessionEvent) (downloader.SessionEvent, bool) {
+	if f.all {
+		return event, true
+	}
+	switch event.Type {
+	case downloader.EVENT_SNAPSHOT:
+		sessions := make([]*downloader.Session, 0, len(event.Sessions))
+		for _, session := range event.Sessions {
+			if session.IsVisibleTo(f.owner) {
+				f.seen[session.ID] = true
+				sessions = append(sessions, session)
+			}
+		}
+		event.Sessions = sessions
+		return event, true
+	case downloader.EVENT_REMOVED:
+		if !f.seen[event.ID] {
+			return event, false
+		}
+		delete(f.seen, event.ID)
+		return event, true
+	}
+	if event.Session == nil {
+		return event, false
+	}
+	if event.Session.IsVisibleTo(f.owner) {
+		f.seen[event.ID] = true
+		return event, true
+	}
+	if f.seen[event.ID] {
+		delete(f.seen, event.ID)
+		return downloader.SessionEvent{Type: downloader.EVENT_REMOVED, ID: event.ID}, true
+	}
+	return event, false
+}
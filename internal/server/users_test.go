@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/internal/config"
+	"github.com/yifeng-qiu/StreamSaver/pkg/downloader"
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// TestQuotaShare lets a user over the quota share media but not start a download
+func TestQuotaShare(t *testing.T) {
+	runner := downloader.NewFakeRunner()
+	runner.Record(downloader.TOOL_YTDLP, downloader.FakeRecording{
+		Stdout: "[info] abc: Downloading 1 format(s): 18\n[download] Destination: /tmp/video.mp4\n" +
+			`[progressbar]{"id":"abc","title":"Video","playlist":"","playlistIndex":1,"playlistCount":1,` +
+			`"progress":{"status":"finished","downloaded_bytes":8192,"total_bytes":8192,"speed":1048576.0,"eta":0}}` + "\n",
+	})
+	cfg := downloader.DefaultConfig()
+	cfg.DownloadRoot = t.TempDir()
+	cfg.HLSRoot = t.TempDir()
+	cfg.SessionLogDir = ""
+	cfg.StallTimeout.Duration = 0
+	cfg.Users = map[string]downloader.UserLimits{"alice": {QuotaBytes: 4096}}
+	dm := downloader.NewDownloadManager(cfg, store.NopStore{}, runner)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dm.Shutdown(ctx)
+	})
+	s := &RequestHandler{Requests: make(map[string]Request), DownloadManager: dm, Tokens: newTestTokens(t, t.TempDir())}
+	server := httptest.NewServer(s.NewHTTPServer(config.ServerConfig{Addr: "127.0.0.1:0"}).Handler)
+	defer server.Close()
+	tokens := make(map[string]string)
+	for _, user := range []string{"alice", "bob"} {
+		token, _, err := s.Tokens.Create("phone", user, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[user] = token
+	}
+	post := func(user string, link string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/new", strings.NewReader(`{"url": "`+link+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /new: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitDownloaded := func(link string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for session := dm.Session(helper.SHAFromString(link)); session == nil || session.BytesTotal == 0; session = dm.Session(helper.SHAFromString(link)) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the download of %s", link)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// sharing the media of bob takes alice beyond the quota
+	if code := post("bob", "https://example.com/watch?v=1"); code != http.StatusOK {
+		t.Fatalf("first post of bob answered %d", code)
+	}
+	waitDownloaded("https://example.com/watch?v=1")
+	if code := post("alice", "https://example.com/watch?v=1"); code != http.StatusOK {
+		t.Fatalf("sharing within the quota answered %d", code)
+	}
+	if code := post("alice", "https://example.com/watch?v=2"); code != http.StatusInsufficientStorage {
+		t.Errorf("new download over the quota answered %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	if s.count() != 1 {
+		t.Errorf("%d requests registered, the refused one is kept", s.count())
+	}
+
+	// media which is downloaded anyway can still be shared
+	if code := post("bob", "https://example.com/watch?v=3"); code != http.StatusOK {
+		t.Fatalf("second post of bob answered %d", code)
+	}
+	waitDownloaded("https://example.com/watch?v=3")
+	if code := post("alice", "https://example.com/watch?v=3"); code != http.StatusOK {
+		t.Errorf("sharing over the quota answered %d, want %d", code, http.StatusOK)
+	}
+}
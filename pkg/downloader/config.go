@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+)
+
+// Config holds the tunable settings of the DownloadManager
+type Config struct {
+	DownloadRoot       string                 `json:"downloadRoot"`        // directory receiving the downloads of yt-dlp
+	HLSRoot            string                 `json:"hlsRoot"`             // directory receiving the HLS output
+	DomainQueueSize    int                    `json:"domainQueueSize"`     // concurrent yt-dlp sessions per domain
+	FFmpegSlots        int                    `json:"ffmpegSlots"`         // concurrent ffmpeg conversions
+	HLSSegmentLength   helper.Duration        `json:"hlsSegmentLength"`    // target duration of an HLS segment
+	HLSAudioCodec      string                 `json:"hlsAudioCodec"`       // codec of audio-only HLS renditions, aac or opus
+	HLSLadder          []Rendition            `json:"hlsLadder,omitempty"` // renditions of adaptive-bitrate HLS, empty for a single rendition
+	Binaries           BinaryPaths            `json:"binaries"`
+	SessionLogDir      string                 `json:"sessionLogDir"`         // directory receiving the tool output of each session, empty to disable
+	SessionLogMaxBytes int                    `json:"sessionLogMaxBytes"`    // size at which a session log is rotated
+	StallTimeout       helper.Duration        `json:"stallTimeout"`          // inactivity after which yt-dlp or ffmpeg is terminated, 0 to disable
+	ProbeTimeout       helper.Duration        `json:"probeTimeout"`          // maximum duration of a metadata probe
+	Options            OptionLimits           `json:"options"`               // download options clients may request
+	Retry              RetryPolicy            `json:"retry"`                 // automatic retries of failed downloads
+	DomainRetry        map[string]RetryPolicy `json:"domainRetry,omitempty"` // retry policies of specific domains and their subdomains
+	UserLimits         UserLimits             `json:"userLimits"`            // limits of every user with authentication enabled
+	Users              map[string]UserLimits  `json:"users,omitempty"`       // limits of specific users
+}
+
+// BinaryPaths locates the external tools, a bare name is looked up in PATH
+type BinaryPaths struct {
+	YtDlp   string `json:"ytdlp"`
+	FFmpeg  string `json:"ffmpeg"`
+	FFprobe string `json:"ffprobe"`
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		DownloadRoot:       "/media/download",
+		HLSRoot:            "/media/hls",
+		DomainQueueSize:    2,
+		FFmpegSlots:        1,
+		HLSSegmentLength:   helper.Duration{Duration: 10 * time.Second},
+		HLSAudioCodec:      "aac",
+		SessionLogDir:      "/media/download/.streamsaver/logs",
+		SessionLogMaxBytes: 1 << 20,
+		StallTimeout:       helper.Duration{Duration: 5 * time.Minute},
+		ProbeTimeout:       helper.Duration{Duration: 30 * time.Second},
+		Options:            DefaultOptionLimits(),
+		Retry:              DefaultRetryPolicy(),
+		Binaries: BinaryPaths{
+			YtDlp:   string(TOOL_YTDLP),
+			FFmpeg:  string(TOOL_FFMPEG),
+			FFprobe: string(TOOL_FFPROBE),
+		},
+	}
+}
+
+// Validate reports the first invalid setting
+func (c Config) Validate() error {
+	if c.DownloadRoot == "" || !filepath.IsAbs(c.DownloadRoot) {
+		return fmt.Errorf("downloadRoot must be an absolute path, got %q", c.DownloadRoot)
+	}
+	if c.HLSRoot == "" || !filepath.IsAbs(c.HLSRoot) {
+		return fmt.Errorf("hlsRoot must be an absolute path, got %q", c.HLSRoot)
+	}
+	if c.DomainQueueSize < 1 {
+		return fmt.Errorf("domainQueueSize must be at least 1, got %d", c.DomainQueueSize)
+	}
+	if c.FFmpegSlots < 1 {
+		return fmt.Errorf("ffmpegSlots must be at least 1, got %d", c.FFmpegSlots)
+	}
+	if c.HLSSegmentLength.Duration < time.Second {
+		return fmt.Errorf("hlsSegmentLength must be at least 1s, got %s", c.HLSSegmentLength)
+	}
+	if _, ok := hlsAudioEncoders[c.HLSAudioCodec]; !ok {
+		return fmt.Errorf("hlsAudioCodec must be aac or opus, got %q", c.HLSAudioCodec)
+	}
+	if err := validateLadder(c.HLSLadder); err != nil {
+		return fmt.Errorf("invalid hlsLadder: %w", err)
+	}
+	if c.SessionLogDir != "" && !filepath.IsAbs(c.SessionLogDir) {
+		return fmt.Errorf("sessionLogDir must be an absolute path, got %q", c.SessionLogDir)
+	}
+	if c.SessionLogMaxBytes < 4096 {
+		return fmt.Errorf("sessionLogMaxBytes must be at least 4096, got %d", c.SessionLogMaxBytes)
+	}
+	if c.StallTimeout.Duration < 0 {
+		return fmt.Errorf("stallTimeout cannot be negative, got %s", c.StallTimeout)
+	}
+	if c.ProbeTimeout.Duration <= 0 {
+		return fmt.Errorf("probeTimeout must be positive, got %s", c.ProbeTimeout)
+	}
+	if err := c.Options.Validate(); err != nil {
+		return fmt.Errorf("invalid option limits: %w", err)
+	}
+	if err := c.Retry.Validate(false); err != nil {
+		return fmt.Errorf("invalid retry policy: %w", err)
+	}
+	for domain, policy := range c.DomainRetry {
+		if err := policy.Validate(true); err != nil {
+			return fmt.Errorf("invalid retry policy for %s: %w", domain, err)
+		}
+		if err := policy.inherit(c.Retry).Validate(false); err != nil {
+			return fmt.Errorf("invalid retry policy for %s: %w", domain, err)
+		}
+	}
+	if err := c.UserLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid user limits: %w", err)
+	}
+	for user, limits := range c.Users {
+		if err := limits.Validate(); err != nil {
+			return fmt.Errorf("invalid limits for user %s: %w", user, err)
+		}
+	}
+	if c.Binaries.YtDlp == "" || c.Binaries.FFmpeg == "" || c.Binaries.FFprobe == "" {
+		return fmt.Errorf("binary paths cannot be empty")
+	}
+	return nil
+}
+
+// Runner returns an ExecRunner invoking the configured binaries
+func (c Config) Runner() *ExecRunner {
+	return NewExecRunner(map[Tool]string{
+		TOOL_YTDLP:   c.Binaries.YtDlp,
+		TOOL_FFMPEG:  c.Binaries.FFmpeg,
+		TOOL_FFPROBE: c.Binaries.FFprobe,
+	})
+}
+
+// hlsSegmentSeconds returns the segment length in seconds as expected by ffmpeg, fractions
+// such as 1.5 are kept
+func (c Config) hlsSegmentSeconds() string {
+	return strconv.FormatFloat(c.HLSSegmentLength.Seconds(), 'f', -1, 64)
+}
@@ -2,91 +2,220 @@ package downloader
 
 import (
 	"fmt"
+	"log/slog"
 	"net/url"
+	"sync"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
 )
 
 // DownloadManger maintains a map of Downloaders, a map of queues per domain, list of sessions and
-// a non-buffered channel as queue for ffmpeg instantiation
+// a non-buffered channel as queue for ffmpeg instantiation.
+// The registry is safe for concurrent use, all maps and the session list are guarded by mu.
 type DownloadManager struct {
+	mu             sync.Mutex
 	Downloaders    map[string]*Downloader
-	DownloadQueues map[string]chan bool // queue per domain for scheduling download sessions
+	DownloadQueues map[string]*slotQueue // queue per domain for scheduling download sessions
+	UserQueues     map[string]*slotQueue // queue per user limiting their concurrent downloads
 	SessionsInfo   []*Session
 	ffmpegQueue    chan bool // only allow one instance of ffmpeg
+	probeQueue     chan bool // bounds the concurrent yt-dlp probes
+	config         Config
+	store          store.Store // persists sessions across restarts
+	runner         ToolRunner  // starts yt-dlp, ffmpeg and ffprobe
+	events         *eventHub   // publishes session changes to subscribers
+	closing        bool        // set by Shutdown, no new work is accepted
 }
 
-// NewDownloadManager returns an instance of DownloadManager
-func NewDownloadManager() DownloadManager {
-	return DownloadManager{
+// NewDownloadManager returns an instance of DownloadManager. Sessions are persisted to
+// stateStore, pass store.NopStore{} to disable persistence. External tools are started
+// through runner, a nil runner uses the binaries of the config.
+func NewDownloadManager(config Config, stateStore store.Store, runner ToolRunner) *DownloadManager {
+	if stateStore == nil {
+		stateStore = store.NopStore{}
+	}
+	if runner == nil {
+		runner = config.Runner()
+	}
+	return &DownloadManager{
 		Downloaders:    make(map[string]*Downloader),
-		DownloadQueues: make(map[string]chan bool),
+		DownloadQueues: make(map[string]*slotQueue),
+		UserQueues:     make(map[string]*slotQueue),
 		SessionsInfo:   make([]*Session, 0),
-		ffmpegQueue:    make(chan bool, 1),
+		ffmpegQueue:    make(chan bool, config.FFmpegSlots),
+		probeQueue:     make(chan bool, maxConcurrentProbes),
+		config:         config,
+		store:          stateStore,
+		runner:         runner,
+		events:         newEventHub(),
 	}
 }
 
+var ErrSessionNotFound = fmt.Errorf("session not found")
+var ErrCannotPause = fmt.Errorf("the download is not running and cannot be paused")
+var ErrCannotResume = fmt.Errorf("the download is not paused and cannot be resumed")
+var ErrShuttingDown = fmt.Errorf("the server is shutting down")
+var ErrInvalidURL = fmt.Errorf("the URL cannot be parsed")
+
 // postSession is a function type that takes a pointer to a Session.
 // It is defined this way to avoid circular imports between packages.
 type postSession func(session *Session)
 
 func (dm *DownloadManager) PostSession(session *Session) {
+	dm.mu.Lock()
 	dm.SessionsInfo = append(dm.SessionsInfo, session)
+	dm.mu.Unlock()
+	dm.sessionChanged(session)
+}
+
+// Sessions returns a consistent snapshot of all sessions, suitable for JSON encoding
+func (dm *DownloadManager) Sessions() []*Session {
+	dm.mu.Lock()
+	sessions := make([]*Session, len(dm.SessionsInfo))
+	copy(sessions, dm.SessionsInfo)
+	dm.mu.Unlock()
+
+	snapshots := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		snapshots = append(snapshots, session.Snapshot())
+	}
+	return snapshots
+}
 
+// Session returns a snapshot of the session associated with shaKey, nil if not found
+func (dm *DownloadManager) Session(shaKey string) *Session {
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return nil
+	}
+	if session := downloader.session(); session != nil {
+		return session.Snapshot()
+	}
+	return nil
 }
 
 // remove a session from the session list.
 func (dm *DownloadManager) removeSession(shaKey string) {
+	dm.mu.Lock()
 	var idx int = -1
-	for idx = range dm.SessionsInfo {
-		if dm.SessionsInfo[idx].ID == shaKey {
+	var session *Session
+	for i := range dm.SessionsInfo {
+		if dm.SessionsInfo[i].ID == shaKey {
+			idx = i
 			break
 		}
 	}
 	if idx != -1 {
+		session = dm.SessionsInfo[idx]
 		dm.SessionsInfo = append(dm.SessionsInfo[:idx], dm.SessionsInfo[idx+1:]...)
 	}
+	dm.mu.Unlock()
+	if session != nil {
+		session.toolLog.Remove()
+	}
+	if err := dm.store.Delete(storeKindSessions, shaKey); err != nil {
+		slog.Error("unable to remove session from store", logKeySession, shaKey, "error", err)
+	}
+}
+
+// isRegistered reports whether a downloader exists for shaKey
+func (dm *DownloadManager) isRegistered(shaKey string) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	_, ok := dm.Downloaders[shaKey]
+	return ok
 }
 
 func (dm *DownloadManager) removeDownloader(shaKey string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 	delete(dm.Downloaders, shaKey)
 }
 
-// Initiate a new downloader or resume an existing one.
-func (dm *DownloadManager) NewDownload(shaKey string, urlstring string) {
+// newDownloader creates a Downloader for the given URL attached to the queue of its domain
+// and to the queue of its owner, "" if the download has no owner.
+// Returns nil if the URL cannot be parsed. dm.mu must be held.
+func (dm *DownloadManager) newDownloader(shaKey string, urlstring string, owner string) *Downloader {
+	newURL, err := url.Parse(urlstring)
+	if err != nil {
+		slog.Warn("unable to parse URL", logKeySession, shaKey, "error", err)
+		return nil
+	}
+	host := newURL.Host
+	queue, ok := dm.DownloadQueues[host]
+	if !ok {
+		queue = newSlotQueue(dm.config.DomainQueueSize)
+		dm.DownloadQueues[host] = queue
+	}
+	return &Downloader{
+		shaKey:            shaKey,
+		urlstring:         urlstring,
+		runner:            dm.runner,
+		config:            &dm.config,
+		downloadQueue:     queue,
+		userQueue:         dm.userQueue(owner),
+		ownerQueue:        dm.ownerQueue,
+		quotaError:        dm.runningQuotaError,
+		owners:            appendOwner(nil, owner),
+		ffmpegQueue:       dm.ffmpegQueue,
+		postSessionFunc:   dm.PostSession,
+		onSessionChange:   dm.sessionChanged,
+		onSessionProgress: dm.sessionProgressed,
+		host:              host,
+		onRunFinished:     dm.downloadFinished,
+	}
+}
+
+// NewOptions validates the options requested for a new download against the allowlist
+// of the server and returns them
+func (dm *DownloadManager) NewOptions(patch SessionPatch) (SessionOptions, error) {
+	var options SessionOptions
+	if err := patch.Validate(dm.config.Options); err != nil {
+		return options, err
+	}
+	patch.apply(&options)
+	return options, nil
+}
+
+// Initiate a new downloader or resume an existing one. options and owner are used by a new
+// download, an existing one keeps the options and owners of its session.
+// Returns ErrShuttingDown once Shutdown has been called, ErrInvalidURL if no downloader
+// can be created for the URL and ErrQuotaExceeded if its owners have used up their quota.
+func (dm *DownloadManager) NewDownload(shaKey string, urlstring string, options SessionOptions, owner string) error {
+	owners := []string{owner}
+	if existing := dm.FindDownloader(shaKey); existing != nil {
+		owners = existing.ownerList()
+	}
+	if err := dm.quotaError(owners, false); err != nil {
+		return err
+	}
+	dm.mu.Lock()
+	if dm.closing {
+		dm.mu.Unlock()
+		return ErrShuttingDown
+	}
 	downloader, ok := dm.Downloaders[shaKey]
-	if ok {
-		// existing downloader, restart the download
-		downloader.Start()
-	} else {
-		newURL, err := url.Parse(urlstring)
-		if err == nil {
-			host := newURL.Host
-			queue, ok := dm.DownloadQueues[host]
-			if !ok {
-				queue = make(chan bool, 2)
-				dm.DownloadQueues[host] = queue
-
-			}
-			newDownloader := &Downloader{
-				shaKey:          shaKey,
-				urlstring:       urlstring,
-				downloadQueue:   queue,
-				ffmpegQueue:     dm.ffmpegQueue,
-				postSessionFunc: dm.PostSession,
-			}
-
-			dm.Downloaders[shaKey] = newDownloader
-
-			newDownloader.Start()
-
-		} else {
-			fmt.Print(err.Error())
+	if !ok {
+		downloader = dm.newDownloader(shaKey, urlstring, owner)
+		if downloader == nil {
+			dm.mu.Unlock()
+			return ErrInvalidURL
 		}
+		downloader.options = options
+		dm.Downloaders[shaKey] = downloader
 	}
+	dm.mu.Unlock()
+
+	// an existing downloader simply restarts the download
+	downloader.Start()
+	return nil
 }
 
 // Locate the downloader associated with a given shaKey.
 // Return nil if not found
 func (dm *DownloadManager) FindDownloader(shaKey string) *Downloader {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 	if downloader, ok := dm.Downloaders[shaKey]; ok {
 		return downloader
 
@@ -95,10 +224,65 @@ func (dm *DownloadManager) FindDownloader(shaKey string) *Downloader {
 	}
 }
 
+// IsResumable reports whether the session associated with shaKey was paused, interrupted
+// or has failed and can be restarted with NewDownload
+func (dm *DownloadManager) IsResumable(shaKey string) bool {
+	downloader := dm.FindDownloader(shaKey)
+	return downloader != nil && (downloader.IsPaused() || downloader.hasFailed())
+}
+
+// PauseDownload stops the yt-dlp process of a session while keeping its partial downloads
+func (dm *DownloadManager) PauseDownload(shaKey string) error {
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return ErrSessionNotFound
+	}
+	return downloader.Pause()
+}
+
+// SessionLogPath returns the current log file of a session. The previous generation,
+// if any, has the suffix ".1". The files may not exist before the session starts.
+func (dm *DownloadManager) SessionLogPath(shaKey string) (string, error) {
+	if dm.FindDownloader(shaKey) == nil {
+		return "", ErrSessionNotFound
+	}
+	if dm.config.SessionLogDir == "" {
+		return "", ErrSessionLogDisabled
+	}
+	return sessionLogPath(&dm.config, shaKey), nil
+}
+
+// UpdateSession changes the options of a session and returns its updated snapshot
+func (dm *DownloadManager) UpdateSession(shaKey string, patch SessionPatch) (*Session, error) {
+	if err := patch.Validate(dm.config.Options); err != nil {
+		return nil, err
+	}
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return nil, ErrSessionNotFound
+	}
+	if err := downloader.UpdateOptions(patch); err != nil {
+		return nil, err
+	}
+	return dm.Session(shaKey), nil
+}
+
+// ResumeDownload restarts a paused or failed session, keeping its progress and playlist position
+func (dm *DownloadManager) ResumeDownload(shaKey string) error {
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return ErrSessionNotFound
+	}
+	if !downloader.IsPaused() && !downloader.hasFailed() {
+		return ErrCannotResume
+	}
+	return dm.NewDownload(shaKey, downloader.urlstring, SessionOptions{}, "")
+}
+
 // Cancel an active download and remove it from the list
 // Return true if the removal was successful, false if otherwise
 func (dm *DownloadManager) CancelDownload(shaKey string) bool {
-	// if the downloader is present and its sessionPID is known issue command and kill it
+	// if the downloader is present and its process is running, terminate it
 	downloader := dm.FindDownloader(shaKey)
 	if downloader != nil {
 		downloader.Terminate()
@@ -106,6 +290,7 @@ func (dm *DownloadManager) CancelDownload(shaKey string) bool {
 		dm.removeSession(shaKey)
 		// remove downloader from the downloader map
 		dm.removeDownloader(shaKey)
+		dm.events.publish(SessionEvent{Type: EVENT_REMOVED, ID: shaKey})
 		return true
 	}
 	return false
@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSessionControl drives the same downloads from many goroutines, it is meant
+// to be run with -race
+func TestConcurrentSessionControl(t *testing.T) {
+	config := testConfig(t)
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{
+		Stdout: output(videoOutput(config.DownloadRoot, "abc", "Video", 1, 1, 20)),
+		Delay:  time.Millisecond,
+	})
+	runner.Record(TOOL_FFMPEG, FakeRecording{Stdout: ffmpegProgress})
+	dm := newTestManager(t, config, runner)
+
+	const downloads = 4
+	keys := make([]string, downloads)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("sha%d", i)
+	}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		url := "https://example.com/watch?v=" + key
+		for worker := 0; worker < 3; worker++ {
+			wg.Add(1)
+			go func(key string, worker int) {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					switch (worker + i) % 5 {
+					case 0:
+						if err := dm.NewDownload(key, url, SessionOptions{}, "alice"); err != nil && err != ErrShuttingDown {
+							t.Errorf("NewDownload(%s): %v", key, err)
+						}
+					case 1:
+						dm.PauseDownload(key)
+					case 2:
+						dm.ResumeDownload(key)
+					case 3:
+						for _, session := range dm.Sessions() {
+							_ = session.IsVisibleTo("alice")
+						}
+					case 4:
+						if i > 5 {
+							dm.CancelDownload(key)
+						}
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}(key, worker)
+		}
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		dm.CancelDownload(key)
+	}
+	if sessions := dm.Sessions(); len(sessions) != 0 {
+		t.Errorf("%d sessions left after cancelling every download", len(sessions))
+	}
+}
@@ -3,164 +3,556 @@ package downloader
 import (
 	"bufio"
 	"fmt"
-	"os/exec"
+	"io"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
 )
 
 // Downloader represents a structure responsible for managing and controlling
-// the downloading of resources.
+// the downloading of resources. process, currentSession and the run flags are guarded by mu.
 type Downloader struct {
-	shaKey          string
-	urlstring       string
-	sessionPID      int
-	currentSession  *Session
-	downloadQueue   chan bool
-	ffmpegQueue     chan bool
-	ffmpeg_wg       sync.WaitGroup
-	postSessionFunc postSession
+	mu                sync.Mutex
+	shaKey            string
+	urlstring         string
+	runner            ToolRunner
+	config            *Config
+	process           Process // the running yt-dlp process, nil if not running
+	active            bool    // Start has been called and the run has not finished
+	waiting           bool    // waiting for a slot in the download queue
+	pausing           bool    // Pause has been requested for the current run
+	paused            bool    // the last run ended because of Pause
+	stop              chan bool
+	currentSession    *Session
+	downloadQueue     *slotQueue
+	ffmpegQueue       chan bool
+	ffmpeg_wg         sync.WaitGroup
+	postSessionFunc   postSession
+	onSessionChange   postSession
+	onSessionProgress postSession
+	host              string                       // domain of the URL, selects the queue and the retry policy
+	retries           int                          // automatic retries since the download was last started by the user
+	retryTimer        *time.Timer                  // pending automatic retry, nil if none
+	onRunFinished     func(*Downloader)            // called when a run ends, not when it is paused in the queue
+	options           SessionOptions               // options of the session created by the first run
+	owners            []string                     // users sharing the download, copied to the session created by the first run
+	userQueue         *slotQueue                   // limits the concurrent downloads of the first owner, nil if not limited
+	ownerQueue        func(user string) *slotQueue // queue of another owner, nil if not limited
+	sharedSlots       map[string]*slotQueue        // slots taken from the queues of the other owners while yt-dlp runs, nil otherwise
+	quotaError        func(owners []string) error  // reports when the download takes its owners beyond their quota
+}
+
+// TerminateResult reports how Terminate stopped the processes of a download
+type TerminateResult struct {
+	Ytdlp        StopResult
+	FFmpeg       StopResult
+	RemovedFiles []string // leftover .part and .ytdl files of yt-dlp
+	Err          error    // first failure to stop a process or to remove a file
 }
 
-// Terminate a running downloader and kill the associated yt-dlp process
-// Returns true if successful, otherwise false
-func (d *Downloader) Terminate() bool {
-	fmt.Printf("DEBUG: received request to cancel job:%s \n", d.shaKey)
-	fmt.Printf("DEBUG: the session PID is :%d \n", d.sessionPID)
-	ret := false
-	if d.sessionPID != -1 && d.sessionPID != 0 {
-		cmd := exec.Command("kill", fmt.Sprintf("%d", d.sessionPID))
-		err := cmd.Run()
-		if err == nil {
-			ret = true
+// Stopped reports whether no process of the download is left running
+func (r TerminateResult) Stopped() bool {
+	return r.Ytdlp != STOP_FAILED && r.FFmpeg != STOP_FAILED
+}
+
+// Terminate stops a download for good. yt-dlp and ffmpeg are terminated along with their
+// children, killed if they do not exit within the grace period, and the partial files
+// yt-dlp leaves behind are removed.
+func (d *Downloader) Terminate() TerminateResult {
+	result := d.stopProcesses()
+	if session := d.session(); session != nil {
+		removed, err := session.removePartialFiles()
+		result.RemovedFiles = removed
+		if result.Err == nil {
+			result.Err = err
 		}
 	}
+	log := d.logger()
+	if result.Err != nil {
+		log.Error("download not terminated cleanly", "ytdlp", result.Ytdlp, "ffmpeg", result.FFmpeg, "error", result.Err)
+	} else {
+		log.Info("download terminated", "ytdlp", result.Ytdlp, "ffmpeg", result.FFmpeg, "removedFiles", len(result.RemovedFiles))
+	}
+	return result
+}
 
-	if d.currentSession.sessionPID != -1 && d.currentSession.sessionPID != 0 {
-		cmd := exec.Command("kill", fmt.Sprintf("%d", d.currentSession.sessionPID))
-		err := cmd.Run()
-		if err == nil {
-			ret = true
-		}
+// stopProcesses terminates yt-dlp and the HLS conversions of the session and waits for them
+// to exit, keeping all files
+func (d *Downloader) stopProcesses() TerminateResult {
+	d.mu.Lock()
+	d.cancelRetry()
+	process := d.process
+	session := d.currentSession
+	d.mu.Unlock()
 
+	var result TerminateResult
+	var wg sync.WaitGroup
+	result.FFmpeg = STOP_NOT_RUNNING
+	var ffmpegErr error
+	if session != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.FFmpeg, ffmpegErr = session.interrupt()
+		}()
 	}
-	return ret
+	if process != nil {
+		d.logger().Debug("terminating yt-dlp", "pid", process.Pid())
+	}
+	result.Ytdlp, result.Err = terminateProcess(process, terminateGracePeriod)
+	wg.Wait()
+	if result.Err == nil {
+		result.Err = ffmpegErr
+	}
+	return result
 }
 
 // Start a Downloader. The Downloader must wait until its assigned queue becomes available before
-// invoking yt-dlp. It must also wait for ffmpeg process to complete before returning
-func (d *Downloader) Start() {
+// invoking yt-dlp. It must also wait for ffmpeg process to complete before returning.
+// Returns false if the Downloader is already running.
+func (d *Downloader) Start() bool {
+	return d.start(false)
+}
+
+// start runs the Downloader, retry is set for automatic retries which keep the retry count
+func (d *Downloader) start(retry bool) bool {
+	d.mu.Lock()
+	if d.active {
+		d.mu.Unlock()
+		return false
+	}
+	if !retry {
+		d.retries = 0
+		d.cancelRetry()
+	}
+	d.active = true
+	d.waiting = true
+	d.pausing = false
+	d.paused = false
+	stop := make(chan bool)
+	d.stop = stop
+	session := d.currentSession
+	created := session == nil
+	if created {
+		// the session exists while the download is queued so that its options can be changed
+		session = NewSession(d.shaKey, d.urlstring, d.ffmpegQueue, &d.ffmpeg_wg)
+		session.runner = d.runner
+		session.config = d.config
+		session.onChange = d.onSessionChange
+		session.onProgress = d.onSessionProgress
+		session.toolLog = newSessionLog(d.config, d.shaKey)
+		session.Options = d.options
+		session.Owners = append([]string(nil), d.owners...)
+		d.currentSession = session
+	}
+	d.mu.Unlock()
+	if created {
+		d.postSessionFunc(session)
+	} else {
+		// an interrupted session is restarted, yt-dlp will announce everything from the beginning
+		session.prepareRun(&d.ffmpeg_wg)
+	}
+
 	go func() {
-		d.ffmpeg_wg = sync.WaitGroup{}
-		d.downloadQueue <- true
+		completed := false
+		defer func() {
+			session.toolLog.Close()
+			d.mu.Lock()
+			d.active = false
+			d.mu.Unlock()
+			if completed && d.onRunFinished != nil {
+				d.onRunFinished(d)
+			}
+		}()
+		if d.userQueue != nil && !d.userQueue.Acquire(session.priority, stop) {
+			// paused while waiting in the queue of the user
+			d.finishPause()
+			return
+		}
+		if !d.downloadQueue.Acquire(session.priority, stop) {
+			// paused while waiting in the queue
+			if d.userQueue != nil {
+				d.userQueue.Release()
+			}
+			d.finishPause()
+			return
+		}
+		d.mu.Lock()
+		d.waiting = false
+		d.mu.Unlock()
+		d.takeSharedSlots()
+		session.beginAttempt()
 		d.ytdlp()
-		<-d.downloadQueue
-		fmt.Println("DEBUG: ytdlp execution completed")
+		d.downloadQueue.Release()
+		if d.userQueue != nil {
+			d.userQueue.Release()
+		}
+		d.releaseSharedSlots()
+		d.logger().Debug("yt-dlp run completed")
 		d.ffmpeg_wg.Wait()
-		if d.currentSession.state == STATE_HLS_CONVERSION {
-			d.currentSession.FinishTime = helper.TimeWithoutNanoseconds{Time: time.Now()}
-			d.currentSession.state = STATE_SESSION_COMPLETE
-			d.currentSession.Status = STATUS_COMPLETED
-		} else {
-			d.currentSession.state = STATE_ERROR
-			d.currentSession.Status = STATUS_ERROR
+		switch state := session.currentState(); state {
+		case STATE_HLS_CONVERSION:
+			if session.isInterrupted() {
+				session.pause()
+			} else {
+				session.setState(STATE_SESSION_COMPLETE)
+			}
+		case STATE_PAUSED, STATE_CANCELED, STATE_ERROR:
+		default:
+			session.fail(&ToolError{Code: ERRCODE_PARSER_DESYNC,
+				Message: fmt.Sprintf("yt-dlp finished before the download was complete (state %d)", state)})
 		}
+		session.endAttempt()
+		completed = true
 
 	}()
+	return true
+}
+
+// takeSharedSlots counts the running download for the owners sharing it. They do not
+// hold it up, their slots are taken even if none is free.
+func (d *Downloader) takeSharedSlots() {
+	d.mu.Lock()
+	owners := append([]string(nil), d.owners...)
+	d.sharedSlots = make(map[string]*slotQueue)
+	d.mu.Unlock()
+	if d.ownerQueue == nil {
+		return
+	}
+	for _, owner := range owners {
+		queue := d.ownerQueue(owner)
+		if queue == nil || queue == d.userQueue {
+			continue
+		}
+		d.mu.Lock()
+		// AddOwner may have taken the slot already, RemoveOwner may have removed the owner
+		if d.sharedSlots[owner] == nil && slices.Contains(d.owners, owner) {
+			queue.take()
+			d.sharedSlots[owner] = queue
+		}
+		d.mu.Unlock()
+	}
+}
+
+// releaseSharedSlots frees the slots taken by takeSharedSlots and AddOwner
+func (d *Downloader) releaseSharedSlots() {
+	d.mu.Lock()
+	slots := d.sharedSlots
+	d.sharedSlots = nil
+	d.mu.Unlock()
+	for _, queue := range slots {
+		queue.Release()
+	}
+}
+
+// ownerList returns a copy of the owners of the download
+func (d *Downloader) ownerList() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.owners...)
+}
+
+// Pause stops a queued or running download. yt-dlp is terminated, or killed after
+// terminateGracePeriod, and keeps its .part files so that the download continues where it
+// left off when Resume is called.
+func (d *Downloader) Pause() error {
+	d.mu.Lock()
+	if !d.active && d.retryTimer != nil {
+		// waiting for an automatic retry
+		d.cancelRetry()
+		d.paused = true
+		session := d.currentSession
+		d.mu.Unlock()
+		session.pause()
+		return nil
+	}
+	if !d.active || d.pausing || (!d.waiting && d.process == nil) {
+		// not running, or yt-dlp is done and only the HLS conversion is left
+		d.mu.Unlock()
+		return ErrCannotPause
+	}
+	d.pausing = true
+	close(d.stop)
+	process := d.process
+	d.mu.Unlock()
+
+	if process != nil {
+		d.logger().Info("pausing download", "pid", process.Pid())
+		// yt-dlp is killed if it ignores SIGTERM, the run ends as paused once it exits
+		go func() {
+			if result, err := terminateProcess(process, terminateGracePeriod); err != nil {
+				d.logger().Error("unable to stop yt-dlp", "pid", process.Pid(), "error", err)
+			} else if result == STOP_KILLED {
+				d.logger().Warn("yt-dlp ignored SIGTERM and was killed", "pid", process.Pid())
+			}
+		}()
+	}
+	return nil
+}
+
+// cancelRetry stops a pending automatic retry, d.mu must be held
+func (d *Downloader) cancelRetry() {
+	if d.retryTimer != nil {
+		d.retryTimer.Stop()
+		d.retryTimer = nil
+	}
 }
 
-// Launch a new yt-dlp process via shell command, capture its stdout and stderr output and parse.
+// hasFailed reports whether the last run ended in the error state and may be started again
+func (d *Downloader) hasFailed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.active && d.currentSession != nil && d.currentSession.currentState() == STATE_ERROR
+}
+
+// IsPaused reports whether the downloader is stopped and can be resumed
+func (d *Downloader) IsPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active {
+		return false
+	}
+	if d.paused {
+		return true
+	}
+	return d.currentSession != nil && d.currentSession.currentState() == STATE_PAUSED
+}
+
+// UpdateOptions applies a patch to the options of the session. The title can be changed at
+// any time, settings affecting the download only while it is queued or paused.
+func (d *Downloader) UpdateOptions(patch SessionPatch) error {
+	d.mu.Lock()
+	session := d.currentSession
+	if session == nil {
+		d.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	queued := d.active && d.waiting && !d.pausing
+	paused := !d.active && (d.paused || session.currentState() == STATE_PAUSED)
+	if (patch.changesDownload() || patch.Priority != nil) && !queued && !paused {
+		d.mu.Unlock()
+		return ErrOptionLocked
+	}
+	// applied under d.mu so that a queued run cannot start with half of the patch
+	session.applyPatch(patch)
+	d.mu.Unlock()
+	session.notify()
+	return nil
+}
+
+// finishPause records the end of a run caused by Pause
+func (d *Downloader) finishPause() {
+	d.mu.Lock()
+	d.paused = true
+	session := d.currentSession
+	d.mu.Unlock()
+	if session != nil {
+		session.pause()
+	}
+}
+
+// session returns the current session of the downloader
+func (d *Downloader) session() *Session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.currentSession
+}
+
+// Launch a new yt-dlp process through the ToolRunner, capture its stdout output and parse.
 func (d *Downloader) ytdlp() {
-	defer func() { d.sessionPID = 0 }()
+	defer func() {
+		d.mu.Lock()
+		d.process = nil
+		d.mu.Unlock()
+	}()
 
-	cmd := exec.Command("yt-dlp", d.urlstring)
+	log := d.logger()
+	session := d.session()
 	var wg sync.WaitGroup
 
-	stdout, err := cmd.StdoutPipe()
+	// the URL cannot be mistaken for an option after "--"
+	args := append(session.options().ytdlpArgs(d.config), "--", d.urlstring)
+	session.toolLog.WriteLine(LOGSOURCE_SERVER, "starting yt-dlp "+strings.Join(args, " "))
+	process, err := d.runner.Start(TOOL_YTDLP, args...)
 	if err != nil {
-		fmt.Printf("Debug: Error opening cmd.StdoutPipe(): %v", err.Error())
-	}
-
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("Debug: error when trying to run yt-dlp command: %v", err.Error())
+		log.Error("unable to start yt-dlp", "error", err)
+		session.toolLog.WriteLine(LOGSOURCE_SERVER, "unable to start yt-dlp: "+err.Error())
+		process = nil
 	} else {
-		d.sessionPID = cmd.Process.Pid
-		fmt.Printf("Debug: the PID of the yt-dlp session is %d\n", d.sessionPID)
+		d.mu.Lock()
+		d.process = process
+		pausing := d.pausing
+		d.mu.Unlock()
+		log.Debug("yt-dlp started", "pid", process.Pid())
+		if pausing {
+			// Pause arrived while yt-dlp was starting
+			process.Terminate()
+		}
 	}
 
+	var stdout, stderr io.Reader = strings.NewReader(""), strings.NewReader("")
+	if process != nil {
+		stdout = process.Stdout()
+		stderr = process.Stderr()
+	}
 	scannerStdout := bufio.NewScanner(stdout)
-	// scannerStderr := bufio.NewScanner(stderr)
 
+	// the watchdog terminates yt-dlp when it neither prints anything nor makes progress
+	var stalled atomic.Bool
+	var watch *watchdog
+	timeout := d.config.StallTimeout.Duration
+	if process != nil {
+		watch = newWatchdog(timeout, func() {
+			stalled.Store(true)
+			log.Warn("yt-dlp stalled, terminating", "timeout", timeout)
+			session.toolLog.WriteLine(LOGSOURCE_SERVER, fmt.Sprintf("no progress for %s, terminating yt-dlp", timeout))
+			session.markStall()
+			terminateProcess(process, terminateGracePeriod)
+		})
+	}
+	defer watch.Stop()
+
+	stderrErrors := &errorCollector{errorsOnly: true}
 	combinedOutput := make(chan string, 10) // channel combining both Stdout and Stderr as well as Cmds originating from the server
 
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		for scannerStdout.Scan() {
 			m := scannerStdout.Text()
 			if strings.TrimSpace(m) != "" {
+				session.toolLog.WriteLine(LOGSOURCE_YTDLP_STDOUT, m)
 				combinedOutput <- m
-				// fmt.Println("scannerStdout: ", m)
 			}
 		}
 	}()
+	go func() {
+		defer wg.Done()
+		session.toolLog.Copy(LOGSOURCE_YTDLP_STDERR, stderr, func(line string) {
+			stderrErrors.observe(line)
+			watch.activity()
+		})
+	}()
 	go func() {
 		wg.Wait()
 		close(combinedOutput)
 	}()
 
-	if d.currentSession == nil {
-		d.currentSession = NewSession(d.shaKey, d.urlstring, d.ffmpegQueue, &d.ffmpeg_wg)
-		d.postSessionFunc(d.currentSession)
-	}
-
 	// This is the main loop of the yt-dlp session.
 
+	var parseErr, quotaErr error
 	for m := range combinedOutput {
-		if hasValidPrefix(m) {
-			err = d.currentSession.Parse(m)
-			if err != nil {
-				if d.currentSession.currentVideo != nil {
-					d.currentSession.currentVideo.Status = VIDEOSTATUS_ERROR
+		if parseErr == nil && hasValidPrefix(m) {
+			parseErr = session.Parse(m)
+			if parseErr != nil {
+				log.Error("unable to parse yt-dlp output, terminating download", "error", parseErr)
+				// only signalled, this goroutine has to keep reading for yt-dlp to exit
+				process.Terminate()
+			}
+		}
+		if strings.HasPrefix(m, string(STDOUT_DOWNLOAD_IN_PROGRESS)) {
+			if quotaErr == nil && d.quotaError != nil {
+				// the size of a download is known from its progress
+				if quotaErr = d.quotaError(d.ownerList()); quotaErr != nil {
+					log.Warn("download exceeds the quota of its owners, terminating", "error", quotaErr)
+					session.toolLog.WriteLine(LOGSOURCE_SERVER, quotaErr.Error()+", terminating yt-dlp")
+					go terminateProcess(process, terminateGracePeriod)
 				}
-				fmt.Printf("Error when parsing output due to %s\n", err.Error())
-				fmt.Printf("Terminating download ...\n")
-				d.Terminate()
 			}
+			// progress lines are repeated while a download hangs, only a change counts
+			watch.progress(session.progressMarker())
+		} else if isPostprocessorMessage(m) {
+			// ffmpeg merging or remuxing a long video prints nothing for a while
+			watch.suspend()
+		} else {
+			watch.activity()
 		}
 	}
-	err = cmd.Wait()
-	if err != nil {
+	if process != nil {
+		err = process.Wait()
+	}
+	watch.Stop()
+	if err != nil || parseErr != nil {
 		// Conditions on which this err will be triggered:
 		// 1. if the process is terminated by kill, it will result in error
-		// 2. unsupported url returned by yt-dlp itself.
-		fmt.Printf("Debug: error after cmd.Wait caused by %v \n", err.Error())
-		if strings.Contains(err.Error(), "terminated") {
-			d.currentSession.state = STATE_CANCELED
-		} else {
-			d.currentSession.state = STATE_ERROR
-			fmt.Printf("DEBUG: irrecoverable error occurred during download %s", err.Error())
+		// 2. yt-dlp reports a failure such as an unsupported url, see stderrErrors
+		// 3. the output of yt-dlp could not be followed and it was terminated
+		if err != nil {
+			log.Debug("yt-dlp exited with error", "error", err)
+			session.toolLog.WriteLine(LOGSOURCE_SERVER, "yt-dlp exited with "+err.Error())
+		}
+		d.mu.Lock()
+		pausing := d.pausing
+		d.mu.Unlock()
+		switch {
+		case pausing:
+			d.finishPause()
+		case quotaErr != nil:
+			session.fail(&ToolError{Code: ERRCODE_QUOTA_EXCEEDED, Message: quotaErr.Error(), Err: quotaErr})
+			log.Error("download failed", "code", ERRCODE_QUOTA_EXCEEDED)
+		case stalled.Load():
+			session.fail(&ToolError{Code: ERRCODE_STALLED, Message: fmt.Sprintf("yt-dlp made no progress for %s", timeout), Err: err})
+			log.Error("download failed", "code", ERRCODE_STALLED)
+		case parseErr == nil && isTerminated(err):
+			session.setState(STATE_CANCELED)
+		default:
+			toolErr := stderrErrors.result(err, ERRCODE_YTDLP_FAILED)
+			if stderrErrors.code == "" && parseErr != nil {
+				// the errors of yt-dlp itself are more accurate than a parser desync they caused
+				toolErr = &ToolError{Code: ERRCODE_PARSER_DESYNC, Message: parseErr.Error(), Err: parseErr}
+			}
+			session.fail(toolErr)
+			log.Error("download failed", "code", toolErr.Code, "error", toolErr.Message)
 		}
-
 	} else {
-		// At this point the Session.State should be STATE_REMUX
-		fmt.Printf("yt-dlp finished without error, current state is %d\n", d.currentSession.state)
-		if d.currentSession.state == STATE_REMUX {
-			fmt.Println("Getting file spec")
-			d.currentSession.GetFileSpecs()
-			d.currentSession.SetupHLSConversion()
-			d.currentSession.state = STATE_HLS_CONVERSION
+		// At this point the Session.State should be STATE_REMUX, or STATE_EXTRACT_AUDIO for audio-only downloads
+		state := session.currentState()
+		log.Debug("yt-dlp finished", "state", state)
+		if state == STATE_REMUX || state == STATE_EXTRACT_AUDIO {
+			session.GetFileSpecs()
+			session.SetupHLSConversion()
+			session.setState(STATE_HLS_CONVERSION)
 		}
 	}
 }
 
 func validPrefixes() []string {
-	return []string{"[download]", "[info]", "[progressbar]", "[Merger]", "[VideoRemuxer]"}
+	return []string{"[download]", "[info]", "[progressbar]", "[Merger]", "[VideoRemuxer]", "[VideoConvertor]", "[ExtractAudio]"}
+}
+
+// ignoredMessages are written by yt-dlp for the thumbnails and subtitles saved next to
+// the video, they do not move the parser
+func ignoredMessages() []string {
+	return []string{"[info] Downloading video thumbnail", "[info] Writing video thumbnail",
+		"[info] Video thumbnail is already present", "[info] Writing video subtitles",
+		"[info] Video subtitle"}
+}
+
+// postprocessorPrefixes start the messages of the yt-dlp post-processors running ffmpeg,
+// each is printed when the post-processor starts
+func postprocessorPrefixes() []string {
+	return []string{"[Merger]", "[VideoRemuxer]", "[VideoConvertor]", "[ExtractAudio]", "[EmbedThumbnail]",
+		"[EmbedSubtitle]", "[Metadata]", "[FixupM3u8]", "[FixupM4a]", "[FixupStretched]", "[FixupDuplicateMoov]",
+		"[FixupTimestamp]", "[ModifyChapters]", "[SplitChapters]"}
+}
+
+func isPostprocessorMessage(s string) bool {
+	for _, prefix := range postprocessorPrefixes() {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func hasValidPrefix(s string) bool {
+	for _, message := range ignoredMessages() {
+		if strings.HasPrefix(s, message) {
+			return false
+		}
+	}
 	for _, prefix := range validPrefixes() {
 		if strings.HasPrefix(s, prefix) {
 			return true
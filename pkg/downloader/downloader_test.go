@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPlaylistPipeline replays the download of a playlist by yt-dlp followed by the probe
+// and HLS conversion of every video
+func TestPlaylistPipeline(t *testing.T) {
+	config := testConfig(t)
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{
+		Stdout: output(playlistOutput(config.DownloadRoot, "Recorded playlist", 3, 3)),
+		Delay:  time.Millisecond,
+	})
+	runner.RecordMatching(TOOL_FFPROBE, "format=duration", FakeRecording{Stdout: "12.345\n"})
+	runner.RecordMatching(TOOL_FFPROBE, "stream=width,height", FakeRecording{Stdout: "1920x1080\n"})
+	runner.Record(TOOL_FFMPEG, FakeRecording{Stdout: ffmpegProgress, Delay: time.Millisecond})
+	dm := newTestManager(t, config, runner)
+
+	const sha = "playlist"
+	events, unsubscribe := dm.Subscribe([]string{sha})
+	states := make(map[State]bool)
+	videoStatuses := make(map[VideoStatus]bool)
+	positions := make(map[int]bool)
+	collected := make(chan bool)
+	go func() {
+		defer close(collected)
+		for event := range events {
+			if event.Session == nil {
+				continue
+			}
+			states[event.Session.state] = true
+			positions[event.Session.Playlist_seq] = true
+			for _, video := range event.Session.Videos {
+				videoStatuses[video.Status] = true
+			}
+		}
+	}()
+
+	if err := dm.NewDownload(sha, "https://example.com/playlist?list=recorded", SessionOptions{}, ""); err != nil {
+		t.Fatalf("NewDownload: %v", err)
+	}
+	waitFor(t, "the session to complete", func() bool {
+		session := dm.Session(sha)
+		return session != nil && (session.Status == STATUS_COMPLETED || session.Status == STATUS_ERROR)
+	})
+	unsubscribe()
+	<-collected
+
+	session := dm.Session(sha)
+	if session.state != STATE_SESSION_COMPLETE || session.Status != STATUS_COMPLETED {
+		t.Fatalf("session ended in state %d with status %q: %s", session.state, session.Status, session.ErrorMessage)
+	}
+	if !session.IsPlaylist || session.Title != "Recorded playlist" {
+		t.Errorf("got playlist %v titled %q, want the playlist %q", session.IsPlaylist, session.Title, "Recorded playlist")
+	}
+	if session.Playlist_count != 3 || session.Playlist_seq != 3 {
+		t.Errorf("playlist position %d of %d, want 3 of 3", session.Playlist_seq, session.Playlist_count)
+	}
+	if len(session.Videos) != 3 {
+		t.Fatalf("got %d videos, want 3", len(session.Videos))
+	}
+	streams := make(map[string]bool)
+	for i, video := range session.Videos {
+		if video.Status != VIDEOSTATUS_COMPLETED {
+			t.Errorf("video %d: status %q, want %q", i, video.Status, VIDEOSTATUS_COMPLETED)
+		}
+		if !strings.HasSuffix(video.FileLocation, ".mp4") || !strings.HasPrefix(video.FileLocation, config.DownloadRoot) {
+			t.Errorf("video %d: file %q, want an mp4 file below %q", i, video.FileLocation, config.DownloadRoot)
+		}
+		if !strings.HasPrefix(video.StreamURL, "/") || !strings.HasSuffix(video.StreamURL, ".m3u8") {
+			t.Errorf("video %d: stream URL %q, want the path of a playlist below the HLS root", i, video.StreamURL)
+		}
+		streams[video.StreamURL] = true
+		if video.Duration != "00:00:12" || video.Resolution != "1920x1080" {
+			t.Errorf("video %d: duration %q and resolution %q, want the probed 00:00:12 and 1920x1080",
+				i, video.Duration, video.Resolution)
+		}
+	}
+	if len(streams) != 3 {
+		t.Errorf("got %d distinct stream URLs, want 3", len(streams))
+	}
+
+	for _, state := range []State{STATE_PLAYLIST_SEQ, STATE_DOWNLOAD_IN_PROGRESS, STATE_REMUX, STATE_HLS_CONVERSION, STATE_SESSION_COMPLETE} {
+		if !states[state] {
+			t.Errorf("state %d was never reported", state)
+		}
+	}
+	for _, status := range []VideoStatus{VIDEOSTATUS_DOWNLOADING, VIDEOSTATUS_MERGING, VIDEOSTATUS_REMUXING,
+		VIDEOSTATUS_CONVERTING_TO_HLS, VIDEOSTATUS_COMPLETED} {
+		if !videoStatuses[status] {
+			t.Errorf("video status %q was never reported", status)
+		}
+	}
+	for position := 1; position <= 3; position++ {
+		if !positions[position] {
+			t.Errorf("playlist position %d was never reported", position)
+		}
+	}
+
+	conversions := 0
+	for _, call := range runner.Calls() {
+		if call.Tool == TOOL_FFMPEG && slices.Contains(call.Args, "hls") {
+			conversions++
+		}
+	}
+	if conversions != 3 {
+		t.Errorf("ffmpeg converted %d videos to HLS, want 3", conversions)
+	}
+}
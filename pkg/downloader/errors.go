@@ -0,0 +1,152 @@
+// Classification of the failures of a download into machine readable categories.
+// yt-dlp and ffmpeg only report problems as text on stderr and as exit codes, the
+// rules below turn them into an ErrorCode which clients can act upon.
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// ErrorCode is the category of a failed session or video
+type ErrorCode string
+
+const (
+	ERRCODE_UNSUPPORTED_URL      ErrorCode = "unsupportedURL"
+	ERRCODE_GEO_BLOCKED          ErrorCode = "geoBlocked"
+	ERRCODE_PRIVATE_VIDEO        ErrorCode = "privateVideo"
+	ERRCODE_LOGIN_REQUIRED       ErrorCode = "loginRequired"
+	ERRCODE_UNAVAILABLE          ErrorCode = "unavailable"
+	ERRCODE_RATE_LIMITED         ErrorCode = "rateLimited"
+	ERRCODE_FRAGMENT_UNAVAILABLE ErrorCode = "fragmentUnavailable"
+	ERRCODE_NETWORK              ErrorCode = "network"
+	ERRCODE_DISK_FULL            ErrorCode = "diskFull"
+	ERRCODE_QUOTA_EXCEEDED       ErrorCode = "quotaExceeded"
+	ERRCODE_INVALID_OPTIONS      ErrorCode = "invalidOptions"
+	ERRCODE_YTDLP_FAILED         ErrorCode = "ytdlpFailed"
+	ERRCODE_FFMPEG_FAILED        ErrorCode = "ffmpegFailed"
+	ERRCODE_PARSER_DESYNC        ErrorCode = "parserDesync"
+	ERRCODE_STALLED              ErrorCode = "stalled"
+	ERRCODE_UNKNOWN              ErrorCode = "unknown"
+)
+
+// Retryable reports whether a download failing with this code may succeed when tried again
+func (c ErrorCode) Retryable() bool {
+	switch c {
+	case ERRCODE_RATE_LIMITED, ERRCODE_FRAGMENT_UNAVAILABLE, ERRCODE_NETWORK, ERRCODE_PARSER_DESYNC, ERRCODE_STALLED, ERRCODE_UNKNOWN:
+		return true
+	}
+	return false
+}
+
+// ToolError is a classified failure of an external tool
+type ToolError struct {
+	Code    ErrorCode
+	Message string
+	Err     error // the underlying error, may be nil
+}
+
+func (e *ToolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// errorRule maps messages containing any of the patterns (compared in lower case) to a code
+type errorRule struct {
+	code     ErrorCode
+	patterns []string
+}
+
+// errorRules are evaluated in order, the first match wins
+var errorRules = []errorRule{
+	{ERRCODE_DISK_FULL, []string{"no space left on device", "disk quota exceeded"}},
+	{ERRCODE_UNSUPPORTED_URL, []string{"unsupported url", "is not a valid url"}},
+	{ERRCODE_GEO_BLOCKED, []string{"not available in your country", "geo restriction", "geo-restricted", "geo restricted", "not available from your location"}},
+	{ERRCODE_PRIVATE_VIDEO, []string{"private video", "video is private", "this video is private"}},
+	{ERRCODE_LOGIN_REQUIRED, []string{"sign in to confirm", "login required", "members-only", "use --cookies", "requires authentication"}},
+	{ERRCODE_RATE_LIMITED, []string{"http error 429", "too many requests", "rate-limit", "rate limit"}},
+	{ERRCODE_FRAGMENT_UNAVAILABLE, []string{"fragment", "did not get any data blocks"}},
+	{ERRCODE_UNAVAILABLE, []string{"video unavailable", "has been removed", "http error 404", "http error 410", "this video is not available"}},
+	{ERRCODE_NETWORK, []string{"unable to download webpage", "connection reset", "timed out", "temporary failure in name resolution", "network is unreachable", "http error 5"}},
+}
+
+// classifyMessage returns the code of the first rule matching message
+func classifyMessage(message string) (ErrorCode, bool) {
+	lower := strings.ToLower(message)
+	for _, rule := range errorRules {
+		for _, pattern := range rule.patterns {
+			if strings.Contains(lower, pattern) {
+				return rule.code, true
+			}
+		}
+	}
+	return "", false
+}
+
+// exitCode returns the exit code carried by err, -1 if there is none
+func exitCode(err error) int {
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	return -1
+}
+
+// isTerminated reports whether err stems from a process stopped by a signal
+func isTerminated(err error) bool {
+	var signaled interface{ Sys() any }
+	if errors.As(err, &signaled) {
+		if status, ok := signaled.Sys().(syscall.WaitStatus); ok {
+			return status.Signaled()
+		}
+	}
+	return false
+}
+
+// errorCollector watches the stderr output of a tool and keeps the most relevant error line
+type errorCollector struct {
+	errorsOnly bool      // only consider lines starting with "ERROR", as printed by yt-dlp
+	code       ErrorCode // first classified error, empty if none
+	message    string    // message of the classified error, or the last error line
+}
+
+// observe inspects one line of stderr. yt-dlp prints warnings for conditions it
+// recovers from, so only its error lines are considered.
+func (c *errorCollector) observe(line string) {
+	line = strings.TrimSpace(line)
+	lower := strings.ToLower(line)
+	if line == "" || (c.errorsOnly && !strings.HasPrefix(lower, "error") && !strings.Contains(lower, "no space left on device")) {
+		return
+	}
+	if c.code != "" {
+		return
+	}
+	message := strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+	if code, ok := classifyMessage(message); ok {
+		c.code = code
+		c.message = message
+		return
+	}
+	c.message = message
+}
+
+// result classifies the failure of a tool which exited with err. fallback is used when
+// neither the output nor the exit code identify the problem.
+func (c *errorCollector) result(err error, fallback ErrorCode) *ToolError {
+	if c.code != "" {
+		return &ToolError{Code: c.code, Message: c.message, Err: err}
+	}
+	message := c.message
+	if message == "" && err != nil {
+		message = err.Error()
+	}
+	code := fallback
+	if exitCode(err) == 2 && fallback == ERRCODE_YTDLP_FAILED {
+		// yt-dlp exits with 2 when it rejects its options
+		code = ERRCODE_INVALID_OPTIONS
+	}
+	return &ToolError{Code: code, Message: message, Err: err}
+}
@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIsTerminated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("processes are not reported as signalled on windows")
+	}
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{Stdout: "[download] Destination: /tmp/video.mp4\n", Delay: time.Minute})
+	process, err := runner.Start(TOOL_YTDLP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.Kill()
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"killed", process.Wait(), true},
+		{"wrapped", fmt.Errorf("yt-dlp failed: %w", errFakeTerminated), true},
+		{"exit code", FakeExitError(1), false},
+		{"other error", errors.New("signal: terminated"), false},
+		{"success", nil, false},
+	}
+	for _, test := range tests {
+		if got := isTerminated(test.err); got != test.want {
+			t.Errorf("%s: isTerminated(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Change notifications for sessions. Every change of a Session, whether a new parser
+// state, a progress update or the end of an HLS conversion, is published to subscribers.
+package downloader
+
+import (
+	"log/slog"
+	"sync"
+)
+
+type EventType string
+
+const (
+	EVENT_SNAPSHOT EventType = "snapshot" // all sessions, sent when subscribing
+	EVENT_UPDATE   EventType = "update"   // one session changed
+	EVENT_REMOVED  EventType = "removed"  // one session was deleted
+)
+
+// SessionEvent is delivered to subscribers. Sessions are snapshots and may be encoded freely.
+type SessionEvent struct {
+	Type     EventType  `json:"type"`
+	ID       string     `json:"id,omitempty"`
+	Session  *Session   `json:"session,omitempty"`
+	Sessions []*Session `json:"sessions,omitempty"`
+}
+
+// eventBufferSize is the number of events queued per subscriber. A subscriber whose queue
+// is full is closed rather than missing an event, it subscribes again for a fresh snapshot.
+const eventBufferSize = 32
+
+type subscriber struct {
+	events  chan SessionEvent
+	ids     map[string]bool // sessions of interest, all sessions if empty
+	backlog []SessionEvent  // events published while the snapshot is taken
+	pending bool            // the snapshot is not queued yet
+}
+
+func (sub *subscriber) wants(id string) bool {
+	return len(sub.ids) == 0 || sub.ids[id]
+}
+
+// eventHub fans out session events to subscribers
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*subscriber]bool)}
+}
+
+// subscribe registers a subscriber before snapshot is called, the events published in
+// between are queued after the snapshot
+func (h *eventHub) subscribe(ids []string, snapshot func() []*Session) *subscriber {
+	sub := &subscriber{
+		events:  make(chan SessionEvent, eventBufferSize),
+		ids:     make(map[string]bool),
+		pending: true,
+	}
+	for _, id := range ids {
+		sub.ids[id] = true
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = true
+	h.mu.Unlock()
+
+	sessions := snapshot()
+	filtered := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		if sub.wants(session.ID) {
+			filtered = append(filtered, session)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub.pending = false
+	sub.events <- SessionEvent{Type: EVENT_SNAPSHOT, Sessions: filtered}
+	for _, event := range sub.backlog {
+		if !h.deliver(sub, event) {
+			break
+		}
+	}
+	sub.backlog = nil
+	return sub
+}
+
+// active reports whether anyone is subscribed
+func (h *eventHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) > 0
+}
+
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// remove closes the channel of a subscriber. h.mu must be held.
+func (h *eventHub) remove(sub *subscriber) {
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// deliver queues an event without blocking. A subscriber whose queue is full is removed,
+// deliver returns false then. h.mu must be held.
+func (h *eventHub) deliver(sub *subscriber, event SessionEvent) bool {
+	if sub.pending {
+		sub.backlog = append(sub.backlog, event)
+		return true
+	}
+	select {
+	case sub.events <- event:
+		return true
+	default:
+		slog.Warn("closing a subscriber which fell behind", "queued", len(sub.events))
+		h.remove(sub)
+		return false
+	}
+}
+
+// publish delivers an event to the subscribers interested in its session
+func (h *eventHub) publish(event SessionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		if sub.wants(event.ID) {
+			h.deliver(sub, event)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving a snapshot of the sessions followed by their changes.
+// Only sessions listed in ids are reported, all sessions if ids is empty.
+// The returned function must be called to stop the subscription, it closes the channel.
+// The channel is also closed when eventBufferSize events are waiting to be received, the
+// subscriber then subscribes again to receive a new snapshot.
+func (dm *DownloadManager) Subscribe(ids []string) (<-chan SessionEvent, func()) {
+	sub := dm.events.subscribe(ids, dm.Sessions)
+	return sub.events, func() { dm.events.unsubscribe(sub) }
+}
+
+// sessionChanged persists the session and publishes the change
+func (dm *DownloadManager) sessionChanged(session *Session) {
+	dm.saveSession(session)
+	dm.sessionProgressed(session)
+}
+
+// sessionProgressed publishes a change which is not worth persisting, such as a progress update
+func (dm *DownloadManager) sessionProgressed(session *Session) {
+	if !dm.events.active() || !dm.isRegistered(session.ID) {
+		return
+	}
+	dm.events.publish(SessionEvent{Type: EVENT_UPDATE, ID: session.ID, Session: session.Snapshot()})
+}
@@ -0,0 +1,61 @@
+package downloader
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestSubscribeSnapshotWindow publishes a change while the snapshot is taken, it is
+// delivered after the snapshot
+func TestSubscribeSnapshotWindow(t *testing.T) {
+	hub := newEventHub()
+	sub := hub.subscribe(nil, func() []*Session {
+		hub.publish(SessionEvent{Type: EVENT_REMOVED, ID: "abc"})
+		return []*Session{{ID: "abc"}}
+	})
+	defer hub.unsubscribe(sub)
+	for _, want := range []EventType{EVENT_SNAPSHOT, EVENT_REMOVED} {
+		select {
+		case event := <-sub.events:
+			if event.Type != want {
+				t.Errorf("received %q, want %q", event.Type, want)
+			}
+		default:
+			t.Fatalf("no %q event queued", want)
+		}
+	}
+}
+
+// TestSlowSubscriber publishes to a subscriber which never reads, it is closed instead of
+// missing events while the others keep receiving them
+func TestSlowSubscriber(t *testing.T) {
+	hub := newEventHub()
+	slow := hub.subscribe(nil, func() []*Session { return nil })
+	reader := hub.subscribe(nil, func() []*Session { return nil })
+	defer hub.unsubscribe(reader)
+	<-reader.events
+
+	for i := 0; i < 2*eventBufferSize; i++ {
+		hub.publish(SessionEvent{Type: EVENT_UPDATE, ID: fmt.Sprint(i), Session: &Session{}})
+		if event := <-reader.events; event.ID != fmt.Sprint(i) {
+			t.Fatalf("reader received event %q, want %d", event.ID, i)
+		}
+	}
+	hub.publish(SessionEvent{Type: EVENT_REMOVED, ID: "last"})
+	if event := <-reader.events; event.Type != EVENT_REMOVED {
+		t.Errorf("reader received %q, want %q", event.Type, EVENT_REMOVED)
+	}
+
+	received := 0
+	for range slow.events {
+		received++
+	}
+	if received != eventBufferSize {
+		t.Errorf("slow subscriber received %d events before being closed, want %d", received, eventBufferSize)
+	}
+	// unsubscribing a closed subscriber does nothing
+	hub.unsubscribe(slow)
+	if !hub.active() {
+		t.Error("the reader was removed with the slow subscriber")
+	}
+}
@@ -0,0 +1,220 @@
+// A ToolRunner replaying recorded tool output, used to exercise the whole
+// download, remux and HLS pipeline without network access or media tools.
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errFakeTerminated is returned by Wait for a process stopped by Terminate or Kill
+var errFakeTerminated error = fakeSignalError(syscall.SIGTERM)
+
+// fakeSignalError resembles the exec.ExitError of a process stopped by a signal
+type fakeSignalError syscall.Signal
+
+func (e fakeSignalError) Error() string { return "signal: " + syscall.Signal(e).String() }
+
+func (e fakeSignalError) ExitCode() int { return -1 }
+
+func (e fakeSignalError) Sys() any { return signaledStatus(syscall.Signal(e)) }
+
+// FakeExitError can be used as FakeRecording.Err to simulate a non-zero exit code
+type FakeExitError int
+
+func (e FakeExitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e FakeExitError) ExitCode() int { return int(e) }
+
+// FakeRecording describes the behaviour of one fake tool invocation
+type FakeRecording struct {
+	Stdout string        // replayed line by line
+	Stderr string        // available at once
+	Delay  time.Duration // pause before each line
+	Err    error         // returned by Wait once all lines are replayed
+	// IgnoreTerminate makes the process ignore SIGTERM, only Kill stops it
+	IgnoreTerminate bool
+}
+
+// FakeCall records one invocation of the FakeRunner
+type FakeCall struct {
+	Tool Tool
+	Args []string
+}
+
+// FakeRunner replays recordings instead of starting processes. The recordings of each
+// tool are consumed in order and the last one is reused for further invocations.
+// Tools without a recording exit successfully without output.
+type FakeRunner struct {
+	mu         sync.Mutex
+	recordings map[Tool][]FakeRecording
+	matching   []*fakeMatch
+	calls      []FakeCall
+	nextPid    int
+}
+
+// fakeMatch holds the recordings of invocations with a given argument
+type fakeMatch struct {
+	tool       Tool
+	arg        string
+	recordings []FakeRecording
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		recordings: make(map[Tool][]FakeRecording),
+		nextPid:    1000,
+	}
+}
+
+// Record appends recordings for a tool
+func (r *FakeRunner) Record(tool Tool, recordings ...FakeRecording) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recordings[tool] = append(r.recordings[tool], recordings...)
+}
+
+// RecordMatching appends recordings for the invocations of a tool with an argument
+// containing arg, e.g. the ffprobe queries of one property. They take precedence over
+// the recordings of Record.
+func (r *FakeRunner) RecordMatching(tool Tool, arg string, recordings ...FakeRecording) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, match := range r.matching {
+		if match.tool == tool && match.arg == arg {
+			match.recordings = append(match.recordings, recordings...)
+			return
+		}
+	}
+	r.matching = append(r.matching, &fakeMatch{tool: tool, arg: arg, recordings: recordings})
+}
+
+// next returns the recording of an invocation, r.mu must be held
+func (r *FakeRunner) next(tool Tool, args []string) FakeRecording {
+	for _, match := range r.matching {
+		if match.tool != tool || len(match.recordings) == 0 || !slices.ContainsFunc(args, func(a string) bool {
+			return strings.Contains(a, match.arg)
+		}) {
+			continue
+		}
+		recording := match.recordings[0]
+		if len(match.recordings) > 1 {
+			match.recordings = match.recordings[1:]
+		}
+		return recording
+	}
+	recording := FakeRecording{}
+	if queue := r.recordings[tool]; len(queue) > 0 {
+		recording = queue[0]
+		if len(queue) > 1 {
+			r.recordings[tool] = queue[1:]
+		}
+	}
+	return recording
+}
+
+// Calls returns all invocations so far
+func (r *FakeRunner) Calls() []FakeCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]FakeCall, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+func (r *FakeRunner) Start(tool Tool, args ...string) (Process, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, FakeCall{Tool: tool, Args: append([]string(nil), args...)})
+	recording := r.next(tool, args)
+	r.nextPid++
+	pid := r.nextPid
+	r.mu.Unlock()
+
+	reader, writer := io.Pipe()
+	process := &fakeProcess{
+		pid:             pid,
+		stdout:          reader,
+		stderr:          strings.NewReader(recording.Stderr),
+		terminated:      make(chan bool),
+		done:            make(chan bool),
+		exited:          make(chan bool),
+		ignoreTerminate: recording.IgnoreTerminate,
+	}
+	go process.replay(recording, writer)
+	return process, nil
+}
+
+type fakeProcess struct {
+	pid             int
+	stdout          *io.PipeReader
+	stderr          io.Reader
+	terminated      chan bool
+	once            sync.Once
+	done            chan bool
+	exited          chan bool
+	exitOnce        sync.Once
+	err             error
+	ignoreTerminate bool
+}
+
+func (p *fakeProcess) replay(recording FakeRecording, writer *io.PipeWriter) {
+	defer close(p.done)
+	defer writer.Close()
+	p.err = recording.Err
+	if recording.Stdout == "" {
+		return
+	}
+	for _, line := range strings.SplitAfter(recording.Stdout, "\n") {
+		if line == "" {
+			continue
+		}
+		select {
+		case <-p.terminated:
+			p.err = errFakeTerminated
+			return
+		case <-time.After(recording.Delay):
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		if _, err := io.WriteString(writer, line); err != nil {
+			// the reading end is only closed by Terminate
+			p.err = errFakeTerminated
+			return
+		}
+	}
+}
+
+func (p *fakeProcess) Pid() int { return p.pid }
+
+func (p *fakeProcess) Stdout() io.Reader { return p.stdout }
+
+func (p *fakeProcess) Stderr() io.Reader { return p.stderr }
+
+func (p *fakeProcess) Wait() error {
+	<-p.done
+	p.exitOnce.Do(func() { close(p.exited) })
+	return p.err
+}
+
+func (p *fakeProcess) Exited() <-chan bool { return p.exited }
+
+func (p *fakeProcess) Terminate() error {
+	if p.ignoreTerminate {
+		return nil
+	}
+	return p.Kill()
+}
+
+func (p *fakeProcess) Kill() error {
+	p.once.Do(func() {
+		close(p.terminated)
+		p.stdout.Close()
+	})
+	return nil
+}
@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// testConfig returns the default config writing below temporary directories, without
+// session logs and without the watchdog
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	config := DefaultConfig()
+	config.DownloadRoot = t.TempDir()
+	config.HLSRoot = t.TempDir()
+	config.SessionLogDir = ""
+	config.StallTimeout.Duration = 0
+	config.Retry.MaxAttempts = 1
+	return config
+}
+
+// newTestManager returns a DownloadManager starting the tools through runner. The
+// downloads are shut down when the test ends.
+func newTestManager(t *testing.T, config Config, runner ToolRunner) *DownloadManager {
+	t.Helper()
+	dm := NewDownloadManager(config, store.NopStore{}, runner)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dm.Shutdown(ctx)
+	})
+	return dm
+}
+
+// progressLine returns a progress report as printed through progressTemplate
+func progressLine(id string, title string, index int, count int, status string, downloaded int64, total int64) string {
+	playlist := `""`
+	if count > 1 {
+		playlist = `"Recorded playlist"`
+	}
+	return fmt.Sprintf(`[progressbar]{"id":"%s","title":"%s","playlist":%s,"playlistIndex":%d,"playlistCount":%d,`+
+		`"progress":{"status":"%s","downloaded_bytes":%d,"total_bytes":%d,"speed":1048576.0,"eta":3}}`,
+		id, title, playlist, index, count, status, downloaded, total)
+}
+
+// videoOutput returns the yt-dlp output downloading one video from separate video and audio
+// formats into folder, merging and remuxing them. progress is the number of progress lines
+// per format.
+func videoOutput(folder string, id string, title string, index int, count int, progress int) []string {
+	base := fmt.Sprintf("%s/%d-%s", folder, index, title)
+	lines := []string{fmt.Sprintf("[info] %s: Downloading 1 format(s): 137+140", id)}
+	for _, format := range []string{"f137.mp4", "f140.m4a"} {
+		lines = append(lines, "[download] Destination: "+base+"."+format)
+		for i := 1; i <= progress; i++ {
+			lines = append(lines, progressLine(id, title, index, count, "downloading", int64(i)*1024, int64(progress)*1024))
+		}
+		lines = append(lines, progressLine(id, title, index, count, "finished", int64(progress)*1024, int64(progress)*1024),
+			"[download] Download completed")
+	}
+	return append(lines,
+		fmt.Sprintf(`[Merger] Merging formats into "%s.mp4"`, base),
+		"Deleting original file "+base+".f137.mp4 (pass -k to keep)",
+		fmt.Sprintf(`[VideoRemuxer] Not remuxing media file "%s.mp4"; already is in target format mp4`, base))
+}
+
+// playlistOutput returns the yt-dlp output downloading a playlist of count videos
+func playlistOutput(folder string, title string, count int, progress int) []string {
+	lines := []string{"[download] Downloading playlist: " + title,
+		fmt.Sprintf("[youtube:tab] Playlist %s: Downloading %d items of %d", title, count, count)}
+	for index := 1; index <= count; index++ {
+		lines = append(lines, fmt.Sprintf("[download] Downloading item %d of %d", index, count))
+		lines = append(lines, videoOutput(folder, fmt.Sprintf("id%d", index), fmt.Sprintf("Item %d", index), index, count, progress)...)
+	}
+	return append(lines, "[download] Finished downloading playlist: "+title)
+}
+
+// output joins lines into the stdout of a recording
+func output(lines []string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ffmpegProgress is the -progress output of a finished conversion
+const ffmpegProgress = "out_time_us=1000000\ntotal_size=2048\nprogress=continue\nout_time_us=2000000\ntotal_size=4096\nprogress=end\n"
+
+// waitFor polls condition until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
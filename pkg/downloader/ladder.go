@@ -0,0 +1,148 @@
+// Adaptive-bitrate HLS. A configured ladder of renditions is encoded in one ffmpeg pass
+// with -var_stream_map, and a master playlist lists the renditions with their bandwidth,
+// resolution and codecs so that players can switch between them.
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// masterPlaylistName is the file name of the master playlist of a rendition ladder
+const masterPlaylistName = "master.m3u8"
+
+// Rendition is one rung of the HLS ladder
+type Rendition struct {
+	Height       int `json:"height"`                 // video height, 0 for the audio-only rendition
+	VideoBitrate int `json:"videoBitrate,omitempty"` // kbit/s, not used by the audio-only rendition
+	AudioBitrate int `json:"audioBitrate"`           // kbit/s
+}
+
+// name identifies the rendition in the names of its playlist and segments
+func (r Rendition) name() string {
+	if r.Height == 0 {
+		return "audio"
+	}
+	return fmt.Sprintf("%dp", r.Height)
+}
+
+// validateLadder reports the first invalid rendition. A ladder needs at least one video
+// rendition, and each height may only be used once.
+func validateLadder(ladder []Rendition) error {
+	if len(ladder) == 0 {
+		return nil
+	}
+	heights := make(map[int]bool)
+	for _, rendition := range ladder {
+		switch {
+		case rendition.Height < 0:
+			return fmt.Errorf("height cannot be negative, got %d", rendition.Height)
+		case heights[rendition.Height]:
+			return fmt.Errorf("height %d is used by more than one rendition", rendition.Height)
+		case rendition.Height > 0 && rendition.VideoBitrate <= 0:
+			return fmt.Errorf("videoBitrate of the %s rendition must be positive", rendition.name())
+		case rendition.AudioBitrate <= 0:
+			return fmt.Errorf("audioBitrate of the %s rendition must be positive", rendition.name())
+		}
+		heights[rendition.Height] = true
+	}
+	if len(heights) == 1 && heights[0] {
+		return fmt.Errorf("the ladder needs at least one video rendition")
+	}
+	return nil
+}
+
+// ladderFor returns the renditions a video with the given "WxH" resolution is encoded into.
+// Renditions above the height of the video are skipped, and only the lowest video rendition
+// is kept if the height is unknown so that the video is not upscaled. nil means that the
+// video is converted into a single rendition, because no ladder is configured or the video
+// is smaller than all video renditions.
+func (c Config) ladderFor(resolution string) []Rendition {
+	sourceHeight := 0
+	if _, height, ok := strings.Cut(resolution, "x"); ok {
+		sourceHeight, _ = strconv.Atoi(height)
+	}
+	if sourceHeight <= 0 {
+		// the lowest video rendition stands in for the height of the video
+		for _, rendition := range c.HLSLadder {
+			if rendition.Height > 0 && (sourceHeight <= 0 || rendition.Height < sourceHeight) {
+				sourceHeight = rendition.Height
+			}
+		}
+	}
+	ladder := make([]Rendition, 0, len(c.HLSLadder))
+	videos := 0
+	for _, rendition := range c.HLSLadder {
+		if rendition.Height > sourceHeight {
+			continue
+		}
+		if rendition.Height > 0 {
+			videos += 1
+		}
+		ladder = append(ladder, rendition)
+	}
+	if videos == 0 {
+		return nil
+	}
+	return ladder
+}
+
+// ladderArgs returns the ffmpeg arguments encoding input into the renditions of the ladder.
+// The variant playlists and segments are written into folder next to the master playlist.
+// Key frames are forced at the segment boundaries so that the segments of all renditions
+// line up. Without hasAudio the video renditions carry no audio and the audio-only
+// rendition is left out.
+func (c Config) ladderArgs(input string, folder string, ladder []Rendition, hasAudio bool) []string {
+	videos := make([]Rendition, 0, len(ladder))
+	audios := make([]Rendition, 0, 1)
+	for _, rendition := range ladder {
+		if rendition.Height > 0 {
+			videos = append(videos, rendition)
+		} else if hasAudio {
+			audios = append(audios, rendition)
+		}
+	}
+
+	filter := fmt.Sprintf("[0:v:0]split=%d", len(videos))
+	for i := range videos {
+		filter += fmt.Sprintf("[s%d]", i)
+	}
+	for i, rendition := range videos {
+		filter += fmt.Sprintf(";[s%d]scale=-2:%d[v%d]", i, rendition.Height, i)
+	}
+
+	args := []string{"-i", input, "-filter_complex", filter}
+	streams := make([]string, 0, len(ladder))
+	for i, rendition := range videos {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate*3/2))
+		if !hasAudio {
+			streams = append(streams, fmt.Sprintf("v:%d,name:%s", i, rendition.name()))
+			continue
+		}
+		args = append(args, "-map", "0:a:0",
+			fmt.Sprintf("-c:a:%d", i), "aac",
+			fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", rendition.AudioBitrate))
+		streams = append(streams, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, rendition.name()))
+	}
+	for _, rendition := range audios {
+		index := len(videos)
+		args = append(args, "-map", "0:a:0",
+			fmt.Sprintf("-c:a:%d", index), "aac",
+			fmt.Sprintf("-b:a:%d", index), fmt.Sprintf("%dk", rendition.AudioBitrate))
+		streams = append(streams, fmt.Sprintf("a:%d,name:%s", index, rendition.name()))
+	}
+
+	return append(args, "-preset", "veryfast", "-sc_threshold", "0",
+		"-force_key_frames", "expr:gte(t,n_forced*"+c.hlsSegmentSeconds()+")",
+		"-var_stream_map", strings.Join(streams, " "), "-master_pl_name", masterPlaylistName,
+		"-hls_segment_filename", filepath.Join(folder, "stream_%v_%d.ts"),
+		"-start_number", "0", "-hls_time", c.hlsSegmentSeconds(), "-hls_list_size", "0",
+		"-f", "hls", filepath.Join(folder, "stream_%v.m3u8"), "-loglevel", "info", "-nostats",
+		"-progress", "pipe:1")
+}
@@ -0,0 +1,124 @@
+package downloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testLadder = []Rendition{
+	{Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+	{Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+	{Height: 0, AudioBitrate: 64},
+}
+
+func TestLadderFor(t *testing.T) {
+	config := DefaultConfig()
+	config.HLSLadder = testLadder
+	tests := []struct {
+		resolution string
+		want       []int // heights of the renditions
+	}{
+		{"1920x1080", []int{1080, 720, 360, 0}},
+		{"3840x2160", []int{1080, 720, 360, 0}},
+		{"1280x720", []int{720, 360, 0}},
+		{"854x480", []int{360, 0}},
+		{"256x144", nil},
+		// unknown heights are not upscaled
+		{"", []int{360, 0}},
+		{"1920x", []int{360, 0}},
+		{"NA", []int{360, 0}},
+	}
+	for _, test := range tests {
+		var heights []int
+		for _, rendition := range config.ladderFor(test.resolution) {
+			heights = append(heights, rendition.Height)
+		}
+		if !slices.Equal(heights, test.want) {
+			t.Errorf("ladderFor(%q) = %v, want %v", test.resolution, heights, test.want)
+		}
+	}
+
+	config.HLSLadder = nil
+	if ladder := config.ladderFor("1920x1080"); ladder != nil {
+		t.Errorf("ladderFor without a ladder = %v, want nil", ladder)
+	}
+}
+
+func TestLadderArgs(t *testing.T) {
+	config := DefaultConfig()
+	ladder := []Rendition{testLadder[1], testLadder[2], testLadder[3]}
+
+	args := config.ladderArgs("/media/download/video.mp4", "/media/hls/abc", ladder, true)
+	if got, want := argValue(args, "-var_stream_map"), "v:0,a:0,name:720p v:1,a:1,name:360p a:2,name:audio"; got != want {
+		t.Errorf("-var_stream_map %q, want %q", got, want)
+	}
+	if maps := countArgs(args, "0:a:0"); maps != 3 {
+		t.Errorf("audio mapped %d times, want 3", maps)
+	}
+
+	args = config.ladderArgs("/media/download/video.mp4", "/media/hls/abc", ladder, false)
+	if got, want := argValue(args, "-var_stream_map"), "v:0,name:720p v:1,name:360p"; got != want {
+		t.Errorf("-var_stream_map without audio %q, want %q", got, want)
+	}
+	for _, arg := range args {
+		if arg == "0:a:0" || strings.HasPrefix(arg, "-c:a") || strings.HasPrefix(arg, "-b:a") {
+			t.Errorf("audio argument %q for a video without audio: %v", arg, args)
+		}
+	}
+	if got, want := argValue(args, "-filter_complex"), "[0:v:0]split=2[s0][s1];[s0]scale=-2:720[v0];[s1]scale=-2:360[v1]"; got != want {
+		t.Errorf("-filter_complex %q, want %q", got, want)
+	}
+}
+
+func TestHasAudioStream(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.RecordMatching(TOOL_FFPROBE, "stream=index",
+		FakeRecording{Stdout: "1\n"}, FakeRecording{Stdout: "\n"}, FakeRecording{Err: FakeExitError(1)})
+	for _, want := range []bool{true, false, true} {
+		if got := HasAudioStream(runner, "/media/download/video.mp4"); got != want {
+			t.Errorf("HasAudioStream = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHLSSegmentSeconds(t *testing.T) {
+	config := DefaultConfig()
+	for _, test := range []struct {
+		length time.Duration
+		want   string
+	}{
+		{10 * time.Second, "10"},
+		{1500 * time.Millisecond, "1.5"},
+		{2*time.Second + 250*time.Millisecond, "2.25"},
+	} {
+		config.HLSSegmentLength.Duration = test.length
+		if got := config.hlsSegmentSeconds(); got != test.want {
+			t.Errorf("hlsSegmentSeconds for %s = %q, want %q", test.length, got, test.want)
+		}
+	}
+	config.HLSSegmentLength.Duration = 1500 * time.Millisecond
+	if got := argValue(config.ladderArgs("/media/download/video.mp4", "/media/hls/abc", testLadder[1:2], true), "-hls_time"); got != "1.5" {
+		t.Errorf("-hls_time %q, want 1.5", got)
+	}
+}
+
+// argValue returns the argument following name
+func argValue(args []string, name string) string {
+	if i := slices.Index(args, name); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+func countArgs(args []string, value string) int {
+	count := 0
+	for _, arg := range args {
+		if arg == value {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,28 @@
+package downloader
+
+import "log/slog"
+
+// Log records of the package use the slog default logger with the following fields
+// attached so that the lines of one download can be correlated.
+const (
+	logKeySession = "session"
+	logKeyVideo   = "video"
+)
+
+// logger returns the logger of the session
+func (s *Session) logger() *slog.Logger {
+	return slog.Default().With(logKeySession, s.ID)
+}
+
+// videoLogger returns the logger of the session for one of its videos
+func (s *Session) videoLogger(video *Video) *slog.Logger {
+	if video == nil {
+		return s.logger()
+	}
+	return s.logger().With(logKeyVideo, video.Index)
+}
+
+// logger returns the logger of the downloader
+func (d *Downloader) logger() *slog.Logger {
+	return slog.Default().With(logKeySession, d.shaKey)
+}
@@ -0,0 +1,244 @@
+// User adjustable settings of a session and their translation into yt-dlp arguments.
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SessionOptions are the settings of a session which can be changed by the user
+type SessionOptions struct {
+	Priority      int      `json:"priority"`                // sessions with a higher priority leave the queue first
+	Format        string   `json:"format,omitempty"`        // yt-dlp format selector, replaces the options selecting the format
+	MaxResolution int      `json:"maxResolution,omitempty"` // maximum video height, 0 for no limit
+	VideoCodec    string   `json:"videoCodec,omitempty"`    // preferred video codec, e.g. h264
+	AudioOnly     bool     `json:"audioOnly,omitempty"`     // download the best audio stream only
+	Subtitles     []string `json:"subtitles,omitempty"`     // languages of the subtitles downloaded next to the video
+	Container     string   `json:"container,omitempty"`     // container of the downloaded video, e.g. mp4
+	Title         string   `json:"titleOverride,omitempty"` // replaces the title reported by yt-dlp
+	OutputFolder  string   `json:"outputFolder,omitempty"`  // folder relative to the download root
+}
+
+// SessionPatch describes a partial update of SessionOptions, nil fields are left unchanged
+type SessionPatch struct {
+	Priority      *int      `json:"priority"`
+	Format        *string   `json:"format"`
+	MaxResolution *int      `json:"maxResolution"`
+	VideoCodec    *string   `json:"videoCodec"`
+	AudioOnly     *bool     `json:"audioOnly"`
+	Subtitles     *[]string `json:"subtitles"`
+	Container     *string   `json:"container"`
+	Title         *string   `json:"titleOverride"`
+	OutputFolder  *string   `json:"outputFolder"`
+}
+
+// OptionLimits is the server side allowlist for the download options requested by clients
+type OptionLimits struct {
+	VideoCodecs          []string `json:"videoCodecs"`          // accepted values of videoCodec
+	Containers           []string `json:"containers"`           // accepted values of container
+	MaxSubtitleLanguages int      `json:"maxSubtitleLanguages"` // 0 disables subtitles
+	AllowFormat          bool     `json:"allowFormat"`          // accept raw yt-dlp format selectors
+}
+
+// DefaultOptionLimits returns the allowlist used when nothing is configured
+func DefaultOptionLimits() OptionLimits {
+	return OptionLimits{
+		VideoCodecs:          []string{"h264", "h265", "vp9", "av01"},
+		Containers:           []string{"mp4", "mkv", "webm"},
+		MaxSubtitleLanguages: 5,
+		AllowFormat:          true,
+	}
+}
+
+// Validate reports the first invalid setting
+func (l OptionLimits) Validate() error {
+	for _, codec := range l.VideoCodecs {
+		if !slices.Contains(knownVideoCodecs, codec) {
+			return fmt.Errorf("unknown video codec %q, must be one of %v", codec, knownVideoCodecs)
+		}
+	}
+	for _, container := range l.Containers {
+		if !slices.Contains(knownContainers, container) {
+			return fmt.Errorf("unknown container %q, must be one of %v", container, knownContainers)
+		}
+	}
+	if l.MaxSubtitleLanguages < 0 {
+		return fmt.Errorf("maxSubtitleLanguages cannot be negative, got %d", l.MaxSubtitleLanguages)
+	}
+	return nil
+}
+
+const (
+	minPriority    = -100
+	maxPriority    = 100
+	maxTitleLength = 200
+)
+
+var ErrInvalidOption = fmt.Errorf("invalid option")
+var ErrOptionLocked = fmt.Errorf("the option can no longer be changed in the current state")
+
+// formatSelector restricts format selectors to the characters of the yt-dlp format syntax
+var formatSelector = regexp.MustCompile(`^[A-Za-z0-9_+/*.,:=<>!?~^$\[\]()-]{1,100}$`)
+
+// supportedResolutions are the accepted values of MaxResolution
+var supportedResolutions = []int{0, 144, 240, 360, 480, 720, 1080, 1440, 2160}
+
+// knownVideoCodecs and knownContainers are the values yt-dlp is known to accept for
+// sorting by codec and for merging and remuxing, the allowlist is a subset of them
+var knownVideoCodecs = []string{"h264", "h265", "vp9", "av01"}
+var knownContainers = []string{"mp4", "mkv", "webm", "mov"}
+
+// subtitleLanguage accepts language codes such as en, pt-BR or zh-Hans
+var subtitleLanguage = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Validate reports the first invalid field of the patch. The download options must
+// be allowed by limits.
+func (p SessionPatch) Validate(limits OptionLimits) error {
+	if p.Priority != nil && (*p.Priority < minPriority || *p.Priority > maxPriority) {
+		return fmt.Errorf("%w: priority must be between %d and %d", ErrInvalidOption, minPriority, maxPriority)
+	}
+	if p.Format != nil && *p.Format != "" && !limits.AllowFormat {
+		return fmt.Errorf("%w: format selectors are not allowed by the server", ErrInvalidOption)
+	}
+	if p.Format != nil && *p.Format != "" &&
+		(!formatSelector.MatchString(*p.Format) || strings.HasPrefix(*p.Format, "-")) {
+		return fmt.Errorf("%w: format %q is not a valid format selector", ErrInvalidOption, *p.Format)
+	}
+	if p.VideoCodec != nil && *p.VideoCodec != "" && !slices.Contains(limits.VideoCodecs, *p.VideoCodec) {
+		return fmt.Errorf("%w: videoCodec must be one of %v", ErrInvalidOption, limits.VideoCodecs)
+	}
+	if p.Container != nil && *p.Container != "" && !slices.Contains(limits.Containers, *p.Container) {
+		return fmt.Errorf("%w: container must be one of %v", ErrInvalidOption, limits.Containers)
+	}
+	if p.Subtitles != nil {
+		if len(*p.Subtitles) > limits.MaxSubtitleLanguages {
+			return fmt.Errorf("%w: at most %d subtitle languages are allowed", ErrInvalidOption, limits.MaxSubtitleLanguages)
+		}
+		for _, language := range *p.Subtitles {
+			if !subtitleLanguage.MatchString(language) {
+				return fmt.Errorf("%w: %q is not a valid subtitle language", ErrInvalidOption, language)
+			}
+		}
+	}
+	if p.MaxResolution != nil {
+		supported := false
+		for _, resolution := range supportedResolutions {
+			supported = supported || resolution == *p.MaxResolution
+		}
+		if !supported {
+			return fmt.Errorf("%w: maxResolution must be one of %v", ErrInvalidOption, supportedResolutions)
+		}
+	}
+	if p.Title != nil && (len(*p.Title) > maxTitleLength || strings.ContainsAny(*p.Title, "\r\n")) {
+		return fmt.Errorf("%w: title must be a single line of at most %d bytes", ErrInvalidOption, maxTitleLength)
+	}
+	if p.OutputFolder != nil && *p.OutputFolder != "" && !filepath.IsLocal(*p.OutputFolder) {
+		return fmt.Errorf("%w: outputFolder must be a relative path inside the download root", ErrInvalidOption)
+	}
+	return nil
+}
+
+// changesDownload reports whether the patch touches settings which affect yt-dlp
+func (p SessionPatch) changesDownload() bool {
+	return p.Format != nil || p.MaxResolution != nil || p.VideoCodec != nil || p.AudioOnly != nil ||
+		p.Subtitles != nil || p.Container != nil || p.OutputFolder != nil
+}
+
+// apply copies the set fields of the patch into the options
+func (p SessionPatch) apply(o *SessionOptions) {
+	if p.Priority != nil {
+		o.Priority = *p.Priority
+	}
+	if p.Format != nil {
+		o.Format = *p.Format
+	}
+	if p.MaxResolution != nil {
+		o.MaxResolution = *p.MaxResolution
+	}
+	if p.VideoCodec != nil {
+		o.VideoCodec = *p.VideoCodec
+	}
+	if p.AudioOnly != nil {
+		o.AudioOnly = *p.AudioOnly
+	}
+	if p.Subtitles != nil {
+		o.Subtitles = slices.Clone(*p.Subtitles)
+	}
+	if p.Container != nil {
+		o.Container = *p.Container
+	}
+	if p.Title != nil {
+		o.Title = *p.Title
+	}
+	if p.OutputFolder != nil {
+		o.OutputFolder = filepath.Clean(*p.OutputFolder)
+		if o.OutputFolder == "." {
+			o.OutputFolder = ""
+		}
+	}
+}
+
+// ytdlpArgs returns the yt-dlp arguments implementing the options. They are given on the
+// command line and take precedence over the yt-dlp config file. The progress output
+// expected by the parser is always requested.
+func (o SessionOptions) ytdlpArgs(config *Config) []string {
+	args := progressArgs()
+	switch {
+	case o.Format != "":
+		args = append(args, "-f", o.Format)
+	case o.AudioOnly:
+		args = append(args, "-f", "ba/b")
+	case o.MaxResolution > 0:
+		args = append(args, "-f", fmt.Sprintf("bv*[height<=%[1]d]+ba/b[height<=%[1]d]/b", o.MaxResolution))
+	}
+	if o.VideoCodec != "" && !o.AudioOnly {
+		// a preference, formats with other codecs are used if the codec is not offered
+		args = append(args, "-S", "vcodec:"+o.VideoCodec)
+	}
+	switch {
+	case o.AudioOnly || o.Container == "":
+	case o.Container == "webm":
+		// only VP8, VP9 and AV1 with Vorbis or Opus fit into webm, other formats are merged
+		// into the container chosen by yt-dlp and encoded again
+		args = append(args, "--recode-video", o.Container)
+	default:
+		args = append(args, "--merge-output-format", o.Container, "--remux-video", o.Container)
+	}
+	if o.AudioOnly {
+		// the cover art embedded into the audio file is extracted again for the HLS rendition
+		args = append(args, "--extract-audio", "--embed-thumbnail")
+	}
+	if len(o.Subtitles) > 0 {
+		args = append(args, "--write-subs", "--sub-langs", strings.Join(o.Subtitles, ","))
+	}
+	if o.OutputFolder != "" {
+		folder := filepath.Join(config.DownloadRoot, o.OutputFolder)
+		args = append(args, "-o", folder+"/%(playlist_title|)s/%(playlist_index|1)d-%(title)s.%(ext)s")
+	}
+	return args
+}
+
+// options returns a copy of the options of the session
+func (s *Session) options() SessionOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Options
+}
+
+// priority returns the queue priority of the session
+func (s *Session) priority() int {
+	return s.options().Priority
+}
+
+// applyPatch updates the options of the session. The caller is responsible for notify.
+func (s *Session) applyPatch(p SessionPatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.apply(&s.Options)
+	if p.Title != nil && s.Options.Title != "" {
+		s.Title = s.Options.Title
+	}
+}
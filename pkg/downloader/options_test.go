@@ -0,0 +1,121 @@
+package downloader
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestSessionPatchValidate(t *testing.T) {
+	limits := DefaultOptionLimits()
+	strict := limits
+	strict.AllowFormat = false
+	strict.Containers = []string{"mp4"}
+	strict.MaxSubtitleLanguages = 0
+
+	tests := []struct {
+		name   string
+		patch  SessionPatch
+		limits OptionLimits
+		valid  bool
+	}{
+		{"empty", SessionPatch{}, limits, true},
+		{"priority", SessionPatch{Priority: ptr(100)}, limits, true},
+		{"priority too high", SessionPatch{Priority: ptr(101)}, limits, false},
+		{"priority too low", SessionPatch{Priority: ptr(-101)}, limits, false},
+
+		{"merged selector", SessionPatch{Format: ptr("bv*[height<=720]+ba/b")}, limits, true},
+		{"format ids", SessionPatch{Format: ptr("137+140")}, limits, true},
+		{"sorted selector", SessionPatch{Format: ptr("(bv*[vcodec^=avc1]/bv*)+ba[ext=m4a]/b")}, limits, true},
+		{"empty selector", SessionPatch{Format: ptr("")}, strict, true},
+		{"selector not allowed", SessionPatch{Format: ptr("best")}, strict, false},
+		{"selector with option", SessionPatch{Format: ptr("-exec")}, limits, false},
+		{"selector with space", SessionPatch{Format: ptr("best --exec rm")}, limits, false},
+		{"selector with quote", SessionPatch{Format: ptr(`b[title="x"]`)}, limits, false},
+		{"selector too long", SessionPatch{Format: ptr(strings.Repeat("b/", 51))}, limits, false},
+
+		{"container", SessionPatch{Container: ptr("mkv")}, limits, true},
+		{"container outside the allowlist", SessionPatch{Container: ptr("mkv")}, strict, false},
+		{"unknown container", SessionPatch{Container: ptr("avi")}, limits, false},
+		{"video codec", SessionPatch{VideoCodec: ptr("av01")}, limits, true},
+		{"unknown video codec", SessionPatch{VideoCodec: ptr("mpeg2")}, limits, false},
+		{"resolution", SessionPatch{MaxResolution: ptr(720)}, limits, true},
+		{"unsupported resolution", SessionPatch{MaxResolution: ptr(721)}, limits, false},
+
+		{"audio only", SessionPatch{AudioOnly: ptr(true)}, limits, true},
+		// the video settings are ignored for audio, they are not an error
+		{"audio only with video settings", SessionPatch{AudioOnly: ptr(true), VideoCodec: ptr("h264"),
+			Container: ptr("mp4"), MaxResolution: ptr(1080)}, limits, true},
+		{"audio only with selector", SessionPatch{AudioOnly: ptr(true), Format: ptr("ba")}, limits, true},
+		{"audio only with an unknown container", SessionPatch{AudioOnly: ptr(true), Container: ptr("mp3")}, limits, false},
+
+		{"subtitles", SessionPatch{Subtitles: ptr([]string{"en", "pt-BR", "zh-Hans"})}, limits, true},
+		{"too many subtitles", SessionPatch{Subtitles: ptr([]string{"en", "de", "fr", "es", "it", "nl"})}, limits, false},
+		{"subtitles disabled", SessionPatch{Subtitles: ptr([]string{"en"})}, strict, false},
+		{"all subtitle languages", SessionPatch{Subtitles: ptr([]string{"all"})}, limits, true},
+		{"subtitle pattern", SessionPatch{Subtitles: ptr([]string{"en.*"})}, limits, false},
+
+		{"title", SessionPatch{Title: ptr("My video")}, limits, true},
+		{"multi-line title", SessionPatch{Title: ptr("My\nvideo")}, limits, false},
+		{"long title", SessionPatch{Title: ptr(strings.Repeat("a", maxTitleLength+1))}, limits, false},
+		{"output folder", SessionPatch{OutputFolder: ptr("music/live")}, limits, true},
+		{"absolute output folder", SessionPatch{OutputFolder: ptr("/etc")}, limits, false},
+		{"escaping output folder", SessionPatch{OutputFolder: ptr("../outside")}, limits, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.patch.Validate(test.limits)
+			if test.valid && err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Validate returned %v, want %v", err, ErrInvalidOption)
+			}
+		})
+	}
+}
+
+func TestAudioOnlyArgs(t *testing.T) {
+	config := testConfig(t)
+	options := SessionOptions{AudioOnly: true, VideoCodec: "h264", Container: "mkv", MaxResolution: 720}
+	args := options.ytdlpArgs(&config)
+	for _, arg := range []string{"-S", "--merge-output-format", "--remux-video"} {
+		if slices.Contains(args, arg) {
+			t.Errorf("audio-only download passes the video option %s: %v", arg, args)
+		}
+	}
+	if i := slices.Index(args, "-f"); i < 0 || args[i+1] != "ba/b" {
+		t.Errorf("audio-only download does not select the best audio: %v", args)
+	}
+	if !slices.Contains(args, "--extract-audio") {
+		t.Errorf("audio-only download does not extract the audio: %v", args)
+	}
+
+	// an explicit selector takes precedence over the audio selection
+	options.Format = "ba[ext=m4a]"
+	args = options.ytdlpArgs(&config)
+	if i := slices.Index(args, "-f"); i < 0 || args[i+1] != "ba[ext=m4a]" {
+		t.Errorf("format selector is not used for an audio-only download: %v", args)
+	}
+}
+
+func TestContainerArgs(t *testing.T) {
+	config := testConfig(t)
+	args := SessionOptions{Container: "mkv"}.ytdlpArgs(&config)
+	if argValue(args, "--merge-output-format") != "mkv" || argValue(args, "--remux-video") != "mkv" {
+		t.Errorf("mkv is not merged and remuxed into: %v", args)
+	}
+	// the formats yt-dlp downloads may not fit into webm, they are encoded again
+	args = SessionOptions{Container: "webm", VideoCodec: "h264"}.ytdlpArgs(&config)
+	if argValue(args, "--recode-video") != "webm" {
+		t.Errorf("webm is not recoded: %v", args)
+	}
+	for _, arg := range []string{"--merge-output-format", "--remux-video"} {
+		if slices.Contains(args, arg) {
+			t.Errorf("webm passes %s: %v", arg, args)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Persistence of download sessions. Each Session, including its Videos and
+// SubStreamInfo, is saved as one record in the state store.
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const (
+	storeKindSessions = "sessions"
+	// storeKindCorrupt holds session records which could not be read, they are moved
+	// there so that they are not skipped again on every start
+	storeKindCorrupt = "sessions-corrupt"
+)
+
+// sessionRecord is the on-disk representation of a Session. It carries the
+// parser state which is hidden from the JSON API.
+type sessionRecord struct {
+	Session *Session `json:"session"`
+	State   State    `json:"state"`
+}
+
+// corruptRecord keeps the raw content of an unreadable session record
+type corruptRecord struct {
+	Data  string `json:"data"`
+	Error string `json:"error"`
+}
+
+// saveSession writes a snapshot of the session to the state store. Sessions which
+// have been removed from the manager are not written back.
+func (dm *DownloadManager) saveSession(session *Session) {
+	if !dm.isRegistered(session.ID) {
+		return
+	}
+	snapshot := session.Snapshot()
+	record := sessionRecord{Session: snapshot, State: snapshot.state}
+	if err := dm.store.Put(storeKindSessions, session.ID, record); err != nil {
+		session.logger().Error("unable to persist session", "error", err)
+	}
+}
+
+// Restore loads all sessions from the state store and registers a Downloader for each of them.
+// Sessions that had not finished are marked as paused so that they can be resumed
+// by calling NewDownload with the same key. Unreadable records are moved to the
+// storeKindCorrupt records, their media is left in place.
+func (dm *DownloadManager) Restore() error {
+	return dm.store.Load(storeKindSessions, func(key string, data []byte) error {
+		var record sessionRecord
+		err := json.Unmarshal(data, &record)
+		if err == nil && record.Session == nil {
+			err = errors.New("the record has no session")
+		}
+		if err != nil {
+			return dm.quarantine(key, data, err)
+		}
+		session := record.Session
+		session.state = record.State
+		session.runner = dm.runner
+		session.config = &dm.config
+		session.ffmpegQueue = dm.ffmpegQueue
+		session.onChange = dm.sessionChanged
+		session.onProgress = dm.sessionProgressed
+		session.toolLog = newSessionLog(&dm.config, session.ID)
+		if session.Videos == nil {
+			session.Videos = make([]*Video, 0)
+		}
+		for _, video := range session.Videos {
+			video.restore()
+		}
+		if len(session.Videos) > 0 {
+			session.currentVideo = session.Videos[len(session.Videos)-1]
+		}
+		session.videoCursor = len(session.Videos)
+		if session.isUnfinished() {
+			session.markPaused()
+		}
+
+		// the first owner requested the download, its slots limit the download
+		owner := ""
+		if len(session.Owners) > 0 {
+			owner = session.Owners[0]
+		}
+		dm.mu.Lock()
+		downloader := dm.newDownloader(session.ID, session.URL, owner)
+		if downloader == nil {
+			dm.mu.Unlock()
+			return nil
+		}
+		downloader.owners = append([]string(nil), session.Owners...)
+		downloader.currentSession = session
+		session.ffmpegWg = &downloader.ffmpeg_wg
+		dm.Downloaders[session.ID] = downloader
+		dm.SessionsInfo = append(dm.SessionsInfo, session)
+		dm.mu.Unlock()
+		dm.saveSession(session)
+		return nil
+	})
+}
+
+// quarantine moves an unreadable session record out of the sessions
+func (dm *DownloadManager) quarantine(key string, data []byte, reason error) error {
+	if err := dm.store.Put(storeKindCorrupt, key, corruptRecord{Data: string(data), Error: reason.Error()}); err != nil {
+		return fmt.Errorf("unable to quarantine session record %s %w", key, err)
+	}
+	if err := dm.store.Delete(storeKindSessions, key); err != nil {
+		return fmt.Errorf("unable to remove session record %s %w", key, err)
+	}
+	slog.Error("moved unreadable session record", logKeySession, key, "kind", storeKindCorrupt, "error", reason)
+	return nil
+}
+
+// restore rebuilds the unexported fields of a Video loaded from the state store
+func (v *Video) restore() {
+	if v.SubStream == nil {
+		v.SubStream = make([]*SubStreamInfo, 0)
+	}
+	v.substreamCount = len(v.SubStream)
+	if v.substreamCount > 0 {
+		v.currentSubstream = v.SubStream[v.substreamCount-1]
+	}
+}
+
+// isUnfinished reports whether the session was interrupted before reaching a final state
+func (s *Session) isUnfinished() bool {
+	switch s.state {
+	case STATE_SESSION_COMPLETE, STATE_CANCELED, STATE_ERROR:
+		return false
+	}
+	return true
+}
+
+// markPaused puts an interrupted session and its unfinished videos into the paused state
+func (s *Session) markPaused() {
+	s.state = STATE_PAUSED
+	s.updateStatus()
+	for _, video := range s.Videos {
+		if video.Status != VIDEOSTATUS_COMPLETED {
+			video.Status = VIDEOSTATUS_PAUSED
+		}
+	}
+}
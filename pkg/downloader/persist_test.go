@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+func TestRestoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{ID: "good", URL: "https://example.com/watch?v=1", Title: "Restored"}
+	if err := st.Put(storeKindSessions, "good", sessionRecord{Session: session, State: STATE_SESSION_COMPLETE}); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := map[string]string{"truncated": `{"session": {"id": "trunc`, "empty": `{"state": 3}`}
+	for key, data := range corrupt {
+		if err := os.WriteFile(filepath.Join(dir, storeKindSessions, key+".json"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dm := NewDownloadManager(testConfig(t), st, NewFakeRunner())
+	if err := dm.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if restored := dm.Session("good"); restored == nil || restored.Title != "Restored" {
+		t.Errorf("readable session restored as %+v", restored)
+	}
+	if sessions := dm.Sessions(); len(sessions) != 1 {
+		t.Errorf("%d sessions restored, want 1", len(sessions))
+	}
+
+	quarantined := make(map[string]corruptRecord)
+	st.Load(storeKindCorrupt, func(key string, data []byte) error {
+		var record corruptRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			t.Errorf("quarantined record %s: %v", key, err)
+		}
+		quarantined[key] = record
+		return nil
+	})
+	for key, data := range corrupt {
+		if record, ok := quarantined[key]; !ok || record.Data != data || record.Error == "" {
+			t.Errorf("record %s quarantined as %+v", key, record)
+		}
+		if _, err := os.Stat(filepath.Join(dir, storeKindSessions, key+".json")); !os.IsNotExist(err) {
+			t.Errorf("record %s is still with the sessions", key)
+		}
+	}
+
+	// the next start does not see the unreadable records again
+	dm = NewDownloadManager(testConfig(t), st, NewFakeRunner())
+	if err := dm.Restore(); err != nil || len(dm.Sessions()) != 1 {
+		t.Errorf("second Restore: %d sessions, error %v", len(dm.Sessions()), err)
+	}
+}
@@ -0,0 +1,179 @@
+// Pre-flight inspection of a URL. yt-dlp is run in simulate mode to obtain the metadata
+// and the available formats without downloading anything, so that a client can confirm
+// a download before it is queued.
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ProbeResult describes the media behind a URL as reported by yt-dlp
+type ProbeResult struct {
+	URL        string        `json:"url"`
+	ID         string        `json:"id"`
+	Title      string        `json:"title"`
+	Extractor  string        `json:"extractor"`
+	Duration   float64       `json:"duration,omitempty"` // seconds, 0 if unknown or for playlists
+	Uploader   string        `json:"uploader,omitempty"`
+	Thumbnail  string        `json:"thumbnail,omitempty"`
+	IsPlaylist bool          `json:"isPlaylist"`
+	EntryCount int           `json:"entryCount"`        // number of videos, 1 for a single video
+	Formats    []ProbeFormat `json:"formats,omitempty"` // not listed for playlists
+}
+
+// ProbeFormat is one of the formats yt-dlp can download for a video
+type ProbeFormat struct {
+	ID            string  `json:"id"` // usable in the format option
+	Extension     string  `json:"ext"`
+	Resolution    string  `json:"resolution,omitempty"`
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	FPS           float64 `json:"fps,omitempty"`
+	VideoCodec    string  `json:"vcodec,omitempty"` // "none" for audio only formats
+	AudioCodec    string  `json:"acodec,omitempty"` // "none" for video only formats
+	Size          int64   `json:"size,omitempty"`   // bytes, 0 if unknown
+	SizeEstimated bool    `json:"sizeEstimated,omitempty"`
+	Note          string  `json:"note,omitempty"`
+}
+
+// probeInfo is the part of the yt-dlp info dict used by Probe
+type probeInfo struct {
+	Type       string  `json:"_type"`
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	Extractor  string  `json:"extractor_key"`
+	Duration   float64 `json:"duration"`
+	Uploader   string  `json:"uploader"`
+	Channel    string  `json:"channel"`
+	Thumbnail  string  `json:"thumbnail"`
+	Thumbnails []struct {
+		URL string `json:"url"`
+	} `json:"thumbnails"`
+	PlaylistCount int               `json:"playlist_count"`
+	Entries       []json.RawMessage `json:"entries"`
+	Formats       []struct {
+		ID             string  `json:"format_id"`
+		Ext            string  `json:"ext"`
+		Resolution     string  `json:"resolution"`
+		Width          float64 `json:"width"`
+		Height         float64 `json:"height"`
+		FPS            float64 `json:"fps"`
+		VideoCodec     string  `json:"vcodec"`
+		AudioCodec     string  `json:"acodec"`
+		FileSize       float64 `json:"filesize"`
+		FileSizeApprox float64 `json:"filesize_approx"`
+		Note           string  `json:"format_note"`
+	} `json:"formats"`
+}
+
+// maxConcurrentProbes is the number of yt-dlp probes running at once, further probes wait
+const maxConcurrentProbes = 4
+
+// Probe runs yt-dlp in simulate mode and returns the metadata of the URL. A failure of
+// yt-dlp is returned as *ToolError, e.g. with ERRCODE_UNSUPPORTED_URL. The probe is
+// stopped when ctx is done or after the configured probe timeout, which includes the
+// wait for a free probe slot.
+func (dm *DownloadManager) Probe(ctx context.Context, urlstring string) (*ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, dm.config.ProbeTimeout.Duration)
+	defer cancel()
+
+	select {
+	case dm.probeQueue <- true:
+		defer func() { <-dm.probeQueue }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("probing %s was stopped %w", urlstring, ctx.Err())
+	}
+
+	// playlists are not resolved entry by entry, which would take as long as a download
+	args := []string{"--simulate", "--dump-single-json", "--flat-playlist", "--no-warnings", "--", urlstring}
+	process, err := dm.runner.Start(TOOL_YTDLP, args...)
+	if err != nil {
+		return nil, &ToolError{Code: ERRCODE_YTDLP_FAILED, Message: err.Error(), Err: err}
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			process.Kill()
+		case <-done:
+		}
+	}()
+
+	stderrErrors := &errorCollector{errorsOnly: true}
+	stderrDone := make(chan bool)
+	go func() {
+		data, _ := io.ReadAll(process.Stderr())
+		for _, line := range strings.Split(string(data), "\n") {
+			stderrErrors.observe(line)
+		}
+		close(stderrDone)
+	}()
+	output, readErr := io.ReadAll(process.Stdout())
+	<-stderrDone
+	err = process.Wait()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("probing %s was stopped %w", urlstring, ctx.Err())
+	}
+	if err != nil {
+		return nil, stderrErrors.result(err, ERRCODE_YTDLP_FAILED)
+	}
+	if readErr != nil {
+		return nil, &ToolError{Code: ERRCODE_YTDLP_FAILED, Message: readErr.Error(), Err: readErr}
+	}
+
+	var info probeInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, &ToolError{Code: ERRCODE_PARSER_DESYNC, Message: "unable to decode the metadata reported by yt-dlp", Err: err}
+	}
+	return info.result(urlstring), nil
+}
+
+// result converts the info dict into a ProbeResult
+func (info *probeInfo) result(urlstring string) *ProbeResult {
+	result := &ProbeResult{
+		URL:        urlstring,
+		ID:         info.ID,
+		Title:      info.Title,
+		Extractor:  info.Extractor,
+		Duration:   info.Duration,
+		Uploader:   info.Uploader,
+		Thumbnail:  info.Thumbnail,
+		IsPlaylist: info.Type == "playlist",
+		EntryCount: 1,
+	}
+	if result.Uploader == "" {
+		result.Uploader = info.Channel
+	}
+	if result.Thumbnail == "" && len(info.Thumbnails) > 0 {
+		// yt-dlp orders thumbnails by preference, the best one comes last
+		result.Thumbnail = info.Thumbnails[len(info.Thumbnails)-1].URL
+	}
+	if result.IsPlaylist {
+		result.EntryCount = max(info.PlaylistCount, len(info.Entries))
+	}
+	for _, format := range info.Formats {
+		probeFormat := ProbeFormat{
+			ID:         format.ID,
+			Extension:  format.Ext,
+			Resolution: format.Resolution,
+			Width:      int(format.Width),
+			Height:     int(format.Height),
+			FPS:        format.FPS,
+			VideoCodec: format.VideoCodec,
+			AudioCodec: format.AudioCodec,
+			Size:       int64(format.FileSize),
+			Note:       format.Note,
+		}
+		if probeFormat.Size == 0 && format.FileSizeApprox > 0 {
+			probeFormat.Size = int64(format.FileSizeApprox)
+			probeFormat.SizeEstimated = true
+		}
+		result.Formats = append(result.Formats, probeFormat)
+	}
+	return result
+}
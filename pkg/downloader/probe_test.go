@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRunner reports the highest number of processes running at once
+type countingRunner struct {
+	ToolRunner
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (r *countingRunner) Start(tool Tool, args ...string) (Process, error) {
+	process, err := r.ToolRunner.Start(tool, args...)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.running++
+	r.peak = max(r.peak, r.running)
+	r.mu.Unlock()
+	return &countedProcess{Process: process, runner: r}, nil
+}
+
+type countedProcess struct {
+	Process
+	runner *countingRunner
+	once   sync.Once
+}
+
+func (p *countedProcess) Wait() error {
+	err := p.Process.Wait()
+	p.once.Do(func() {
+		p.runner.mu.Lock()
+		p.runner.running--
+		p.runner.mu.Unlock()
+	})
+	return err
+}
+
+func TestProbeConcurrency(t *testing.T) {
+	config := testConfig(t)
+	fake := NewFakeRunner()
+	fake.Record(TOOL_YTDLP, FakeRecording{
+		Stdout: `{"_type":"video","id":"abc","title":"Video","extractor_key":"Youtube","duration":12}` + "\n",
+		Delay:  20 * time.Millisecond,
+	})
+	runner := &countingRunner{ToolRunner: fake}
+	dm := newTestManager(t, config, runner)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*maxConcurrentProbes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dm.Probe(context.Background(), "https://example.com/watch?v=abc"); err != nil {
+				t.Errorf("Probe: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runner.peak > maxConcurrentProbes {
+		t.Errorf("%d probes ran at once, want at most %d", runner.peak, maxConcurrentProbes)
+	}
+	if calls := len(fake.Calls()); calls != 3*maxConcurrentProbes {
+		t.Errorf("yt-dlp started %d times, want %d", calls, 3*maxConcurrentProbes)
+	}
+}
+
+func TestProbeTimeoutWhileWaiting(t *testing.T) {
+	config := testConfig(t)
+	config.ProbeTimeout.Duration = 50 * time.Millisecond
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{Stdout: "{}\n", Delay: time.Second})
+	dm := newTestManager(t, config, runner)
+	for i := 0; i < maxConcurrentProbes; i++ {
+		dm.probeQueue <- true
+	}
+	defer func() {
+		for i := 0; i < maxConcurrentProbes; i++ {
+			<-dm.probeQueue
+		}
+	}()
+
+	_, err := dm.Probe(context.Background(), "https://example.com/watch?v=abc")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Probe without a free slot returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if calls := len(runner.Calls()); calls != 0 {
+		t.Errorf("yt-dlp started %d times without a free slot", calls)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package downloader
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is not supported on this platform, children are not signalled
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup signals only the process itself on this platform
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return process.Kill()
+	}
+	return process.Signal(sig)
+}
+
+// signaledStatus returns the zero wait status, processes are not reported as signalled
+// on this platform
+func signaledStatus(sig syscall.Signal) syscall.WaitStatus {
+	var status syscall.WaitStatus
+	return status
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package downloader
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command as the leader of a new process group so that
+// the processes it spawns can be signalled along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends sig to the process group led by process
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	// a negative pid addresses the whole group
+	if err := syscall.Kill(-process.Pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
+
+// signaledStatus returns the wait status of a process stopped by sig
+func signaledStatus(sig syscall.Signal) syscall.WaitStatus {
+	return syscall.WaitStatus(sig)
+}
@@ -3,7 +3,11 @@
 
 package downloader
 
-import "fmt"
+import (
+	"log/slog"
+	"math"
+	"strings"
+)
 
 // MARK: struct for storing valid video downloads.
 
@@ -14,6 +18,7 @@ const (
 	VIDEOSTATUS_DOWNLOADING            VideoStatus = "Downloading"
 	VIDEOSTATUS_MERGING                VideoStatus = "Merging"
 	VIDEOSTATUS_REMUXING               VideoStatus = "Remuxing"
+	VIDEOSTATUS_EXTRACTING_AUDIO       VideoStatus = "Extracting audio"
 	VIDEOSTATUS_WAITING_FOR_CONVERSION VideoStatus = "Conversion pending"
 	VIDEOSTATUS_CONVERTING_TO_HLS      VideoStatus = "Converting"
 	VIDEOSTATUS_COMPLETED              VideoStatus = "Completed"
@@ -31,8 +36,21 @@ type Video struct {
 	substreamCount   int              `json:"-"`
 	FileLocation     string           `json:"filelocation"`
 	StreamURL        string           `json:"streamurl"`
+	CoverURL         string           `json:"coverurl,omitempty"` // cover art of an audio-only download, below the HLS root
 	Duration         string           `json:"duration"`
 	Resolution       string           `json:"resolution"`
+	ErrorCode        ErrorCode        `json:"errorCode,omitempty"`
+	ErrorMessage     string           `json:"errorMessage,omitempty"`
+	OverallProgress  float64          `json:"overallProgress"` // 0 to 1 across all substreams, computed by Snapshot
+	BytesDownloaded  int64            `json:"bytesDownloaded"`
+	BytesTotal       int64            `json:"bytesTotal"` // sum of the known substream sizes
+}
+
+// fail marks the video as failed with a classified error
+func (v *Video) fail(toolErr *ToolError) {
+	v.Status = VIDEOSTATUS_ERROR
+	v.ErrorCode = toolErr.Code
+	v.ErrorMessage = toolErr.Message
 }
 
 // Struct SubStreamInfo stores info related to substreams within one video, such as audio, video tracks
@@ -42,6 +60,12 @@ type SubStreamInfo struct {
 	Size     string  `json:"size"`
 	Speed    string  `json:"speed"`
 	Eta      string  `json:"eta"`
+	// numeric values of the fields above
+	DownloadedBytes int64   `json:"downloadedBytes"`
+	TotalBytes      int64   `json:"totalBytes"`            // 0 if unknown
+	BytesPerSecond  float64 `json:"bytesPerSecond"`        // 0 if unknown
+	EtaSeconds      int     `json:"etaSeconds"`            // -1 if unknown
+	Destination     string  `json:"destination,omitempty"` // file announced by yt-dlp, its .part and .ytdl files are removed on cancel
 }
 
 func NewVideo() *Video {
@@ -56,18 +80,84 @@ func NewVideo() *Video {
 
 func NewSubstream(id int) *SubStreamInfo {
 	return &SubStreamInfo{
-		Index:    id,
-		Progress: 0.0,
-		Size:     "",
-		Speed:    "",
-		Eta:      "",
+		Index:      id,
+		Progress:   0.0,
+		Size:       "",
+		Speed:      "",
+		Eta:        "",
+		EtaSeconds: -1,
+	}
+}
+
+// clone returns a deep copy of the video
+func (v *Video) clone() *Video {
+	c := *v
+	c.SubStream = make([]*SubStreamInfo, 0, len(v.SubStream))
+	for _, substream := range v.SubStream {
+		copied := *substream
+		c.SubStream = append(c.SubStream, &copied)
+	}
+	c.currentSubstream = nil
+	return &c
+}
+
+// aggregateProgress computes the overall progress of the video from its substreams.
+// Substreams are weighted by their size when all sizes are known. A video which has
+// moved on to merging, remuxing or conversion is fully downloaded.
+func (v *Video) aggregateProgress() {
+	v.BytesDownloaded, v.BytesTotal = 0, 0
+	sizesKnown := len(v.SubStream) > 0
+	progress := 0.0
+	for _, substream := range v.SubStream {
+		v.BytesDownloaded += substream.DownloadedBytes
+		v.BytesTotal += substream.TotalBytes
+		if substream.TotalBytes == 0 {
+			sizesKnown = false
+		}
+		progress += substream.Progress
+	}
+	switch {
+	case v.isDownloaded():
+		v.OverallProgress = 1
+		if v.BytesTotal > 0 {
+			v.BytesDownloaded = v.BytesTotal
+		}
+	case sizesKnown:
+		v.OverallProgress = math.Min(float64(v.BytesDownloaded)/float64(v.BytesTotal), 1)
+	case len(v.SubStream) > 0:
+		v.OverallProgress = progress / float64(len(v.SubStream))
+	default:
+		v.OverallProgress = 0
 	}
 }
 
+// isDownloaded reports whether yt-dlp is done with the video
+func (v *Video) isDownloaded() bool {
+	switch v.Status {
+	case VIDEOSTATUS_MERGING, VIDEOSTATUS_REMUXING, VIDEOSTATUS_EXTRACTING_AUDIO, VIDEOSTATUS_WAITING_FOR_CONVERSION,
+		VIDEOSTATUS_CONVERTING_TO_HLS, VIDEOSTATUS_COMPLETED:
+		return true
+	}
+	return v.StreamURL != ""
+}
+
 func (v *Video) AddSubstream() {
-	v.currentSubstream = NewSubstream(v.substreamCount)
+	if v.substreamCount < len(v.SubStream) {
+		// the download is resumed, continue with the substream recorded earlier
+		v.currentSubstream = v.SubStream[v.substreamCount]
+	} else {
+		v.currentSubstream = NewSubstream(v.substreamCount)
+		v.SubStream = append(v.SubStream, v.currentSubstream)
+	}
 	v.substreamCount += 1
-	v.SubStream = append(v.SubStream, v.currentSubstream)
+}
+
+// recordDestination keeps the file announced by a "[download] Destination:" line for the
+// current substream
+func (v *Video) recordDestination(message string) {
+	if _, path, ok := strings.Cut(message, string(STDOUT_DOWNLOAD_DESTINATION)); ok && v.currentSubstream != nil {
+		v.currentSubstream.Destination = strings.TrimSpace(path)
+	}
 }
 
 func (v *Video) RemoveAllSubstreams() {
@@ -82,9 +172,13 @@ func (v *Video) GetProgress(message string) bool {
 		v.currentSubstream.Size = pb.Size
 		v.currentSubstream.Speed = pb.Speed
 		v.currentSubstream.Eta = pb.Eta
+		v.currentSubstream.DownloadedBytes = pb.DownloadedBytes
+		v.currentSubstream.TotalBytes = pb.TotalBytes
+		v.currentSubstream.BytesPerSecond = pb.BytesPerSecond
+		v.currentSubstream.EtaSeconds = pb.EtaSeconds
 		return true
 	} else {
-		fmt.Printf("Error when getting progress %s", err.Error())
+		slog.Debug("unable to parse progress", logKeyVideo, v.Index, "line", message, "error", err)
 	}
 	return false
 }
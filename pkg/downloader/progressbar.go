@@ -1,114 +1,144 @@
 // Parser functions for dealing with progress outputs from yt-dlp.
-// The format is
-// Playlist$$__$$Playlist_index$$__$$Playlist_count$$__$$Title$$__$$Combined string of Progress, Size, Speed and Eta
+// The downloader passes its own --progress-template so that every progress line is
+// [progressbar] followed by a JSON object, see progressTemplate. The output does not
+// depend on the yt-dlp config file, the locale or the characters of the title.
 package downloader
 
 import (
+	"encoding/json"
 	"errors"
-	"regexp"
-	"strconv"
+	"fmt"
+	"math"
+	"strings"
 )
 
-const (
-	progress = `([\d\.]+)%`
-	size     = `([\d\.]+[KMGT]iB)`
-	speed    = `([\d\.]+[KMGT]iB/s)`
-	eta      = `((?:\d{2}:){1,2}\d{2})`
-)
+// progressTemplate makes yt-dlp report the progress of a download as JSON. Fields which
+// are missing in the info dict fall back to the value after "|".
+const progressTemplate = "download:" + string(STDOUT_DOWNLOAD_IN_PROGRESS) +
+	`{"id":%(info.id)j,"title":%(info.title)j,"playlist":%(info.playlist_title|"")j,` +
+	`"playlistIndex":%(info.playlist_index|1)j,"playlistCount":%(info.playlist_count|1)j,` +
+	`"progress":%(progress)j}`
 
-type ProgressBar struct {
-	Playlist       string  `json:"playlist"`
-	Playlist_index int     `json:"id"`
-	Playlist_count int     `json:"playlistCount"`
-	Title          string  `json:"title"`
-	Progress       float64 `json:"progress"`
-	Size           string  `json:"size"`
-	Speed          string  `json:"speed"`
-	Eta            string  `json:"eta"`
+// progressArgs returns the yt-dlp arguments producing the output expected by ParseProgressBar
+func progressArgs() []string {
+	return []string{"--newline", "--progress", "--progress-template", progressTemplate}
 }
 
-var ProgressBarRegExps = map[string]*regexp.Regexp{
-	"progress": regexp.MustCompile(progress),
-	"size":     regexp.MustCompile(size),
-	"speed":    regexp.MustCompile(speed),
-	"eta":      regexp.MustCompile(eta),
+// progressReport is the JSON object printed by progressTemplate
+type progressReport struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	Playlist      string `json:"playlist"`
+	PlaylistIndex int    `json:"playlistIndex"`
+	PlaylistCount int    `json:"playlistCount"`
+	Progress      struct {
+		Status             string   `json:"status"`
+		DownloadedBytes    float64  `json:"downloaded_bytes"`
+		TotalBytes         float64  `json:"total_bytes"`
+		TotalBytesEstimate float64  `json:"total_bytes_estimate"`
+		Speed              *float64 `json:"speed"`
+		Eta                *float64 `json:"eta"`
+		FragmentIndex      int      `json:"fragment_index"`
+		FragmentCount      int      `json:"fragment_count"`
+	} `json:"progress"`
+}
+
+type ProgressBar struct {
+	Playlist        string  `json:"playlist"`
+	Playlist_index  int     `json:"id"`
+	Playlist_count  int     `json:"playlistCount"`
+	Title           string  `json:"title"`
+	VideoID         string  `json:"videoId"`
+	Status          string  `json:"status"` // downloading or finished, as reported by yt-dlp
+	Progress        float64 `json:"progress"`
+	DownloadedBytes int64   `json:"downloadedBytes"`
+	TotalBytes      int64   `json:"totalBytes"`     // 0 if unknown, may be an estimate for fragmented downloads
+	BytesPerSecond  float64 `json:"bytesPerSecond"` // 0 if unknown
+	EtaSeconds      int     `json:"etaSeconds"`     // -1 if unknown
+	FragmentIndex   int     `json:"fragmentIndex,omitempty"`
+	FragmentCount   int     `json:"fragmentCount,omitempty"`
+	Size            string  `json:"size"`  // TotalBytes formatted for display
+	Speed           string  `json:"speed"` // BytesPerSecond formatted for display
+	Eta             string  `json:"eta"`   // EtaSeconds formatted for display
 }
 
 // ParseProgressBar parses the progressbar outputs of yt-dlp and store parsed info in a ProgressBar stuct.
 // - ProgressBar: pointer to a ProgressBar struct
 func ParseProgressBar(from string) (*ProgressBar, error) {
+	_, payload, ok := strings.Cut(from, string(STDOUT_DOWNLOAD_IN_PROGRESS))
+	if !ok {
+		return nil, errors.New("not a progress line")
+	}
+	var report progressReport
+	if err := json.Unmarshal([]byte(payload), &report); err != nil {
+		return nil, fmt.Errorf("invalid progress report %w", err)
+	}
+	if len(report.Title) == 0 {
+		return nil, errors.New("could not extract title")
+	}
 	p := ProgressBar{
-		Playlist:       "",
-		Playlist_index: 1,
-		Playlist_count: 1,
-		Title:          "",
-		Progress:       0.0,
-		Size:           "",
-		Speed:          "",
-		Eta:            "",
+		Playlist:        report.Playlist,
+		Playlist_index:  max(report.PlaylistIndex, 1),
+		Playlist_count:  max(report.PlaylistCount, 1),
+		Title:           report.Title,
+		VideoID:         report.ID,
+		Status:          report.Progress.Status,
+		DownloadedBytes: int64(report.Progress.DownloadedBytes),
+		TotalBytes:      int64(report.Progress.TotalBytes),
+		EtaSeconds:      -1,
+		FragmentIndex:   report.Progress.FragmentIndex,
+		FragmentCount:   report.Progress.FragmentCount,
 	}
-	// splitting fields by $$_$$ sign
-	x := regexp.MustCompile(`\$\$__\$\$`).Split(from, -1)
-	// the returned slice of strings must have a length of 5
-	if len(x) < 5 {
-		return nil, errors.New("invalid number of fields") // the string cannot be parsed correctly
+	if p.TotalBytes == 0 {
+		p.TotalBytes = int64(report.Progress.TotalBytesEstimate)
 	}
-	p.Playlist = x[0]
-	val, err := strconv.Atoi(x[1])
-	if err == nil {
-		p.Playlist_index = val
-	} else {
-		p.Playlist_index = 1
+	if report.Progress.Speed != nil {
+		p.BytesPerSecond = *report.Progress.Speed
 	}
-
-	val, err = strconv.Atoi(x[2])
-	if err == nil {
-		p.Playlist_count = val
-	} else {
-		p.Playlist_count = 1
+	if report.Progress.Eta != nil {
+		p.EtaSeconds = int(*report.Progress.Eta)
 	}
 
-	p.Title = x[3]
-	if len(p.Title) == 0 {
-		return nil, errors.New("could not extract title")
+	switch {
+	case p.Status == "finished":
+		p.Progress = 1
+	case p.TotalBytes > 0:
+		p.Progress = math.Min(float64(p.DownloadedBytes)/float64(p.TotalBytes), 1)
+	case p.FragmentCount > 0:
+		p.Progress = math.Min(float64(p.FragmentIndex)/float64(p.FragmentCount), 1)
 	}
-
-	// The remainder of the fields will not throw an error even if not parsed correctly
-	remainder := x[4]
-	str := findMatch(ProgressBarRegExps["progress"], remainder)
-	if len(str) != 0 {
-		if f, err := strconv.ParseFloat(str, 64); err == nil {
-			p.Progress = f / 100.0
-		}
+	if p.TotalBytes > 0 {
+		p.Size = formatBytes(float64(p.TotalBytes))
+	}
+	if p.BytesPerSecond > 0 {
+		p.Speed = formatBytes(p.BytesPerSecond) + "/s"
+	}
+	if p.EtaSeconds >= 0 {
+		p.Eta = formatEta(p.EtaSeconds)
 	}
-	p.Size = findMatch(ProgressBarRegExps["size"], remainder)
-
-	p.Speed = findMatch(ProgressBarRegExps["speed"], remainder)
-
-	p.Eta = findMatch(ProgressBarRegExps["eta"], remainder)
-
 	return &p, nil
 }
 
 // Helper function for copying info between two ProgressBar structs
 func (p *ProgressBar) CopyInto(into *ProgressBar) {
+	*into = *p
+}
 
-	into.Playlist = p.Playlist
-	into.Playlist_count = p.Playlist_count
-	into.Playlist_index = p.Playlist_index
-	into.Title = p.Title
-	into.Progress = p.Progress
-	into.Size = p.Size
-	into.Speed = p.Speed
-	into.Eta = p.Eta
+// formatBytes formats a byte count with binary units the way yt-dlp does, e.g. 12.34MiB
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", bytes, units[unit])
 }
 
-// Helper function for extracting information from a progressbar string.
-func findMatch(reg *regexp.Regexp, from string) string {
-	match := reg.FindSubmatch([]byte(from))
-	if match != nil {
-		return string(match[1])
-	} else {
-		return ""
+// formatEta formats seconds as MM:SS, or HH:MM:SS from one hour on
+func formatEta(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
 	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
 }
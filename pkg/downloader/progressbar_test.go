@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProgressBar(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want ProgressBar
+	}{
+		{
+			name: "single video",
+			line: `[progressbar]{"id":"dQw4w9WgXcQ","title":"Rick Astley - Never Gonna Give You Up (Official Music Video)","playlist":"",` +
+				`"playlistIndex":1,"playlistCount":1,"progress":{"status":"downloading","downloaded_bytes":1048576,"total_bytes":4194304,` +
+				`"tmpfilename":"/media/download/video.f137.mp4.part","filename":"/media/download/video.f137.mp4","eta":3,"speed":1048576.0,` +
+				`"elapsed":1.02,"ctx_id":null,"_eta_str":"00:03","_speed_str":"   1.00MiB/s","_percent_str":" 25.0%",` +
+				`"_total_bytes_str":"   4.00MiB","_total_bytes_estimate_str":"N/A","_downloaded_bytes_str":"   1.00MiB",` +
+				`"_elapsed_str":"00:00:01","_default_template":" 25.0% of    4.00MiB at    1.00MiB/s ETA 00:03"}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Rick Astley - Never Gonna Give You Up (Official Music Video)",
+				VideoID: "dQw4w9WgXcQ", Status: "downloading", Progress: 0.25, DownloadedBytes: 1048576, TotalBytes: 4194304,
+				BytesPerSecond: 1048576, EtaSeconds: 3, Size: "4.00MiB", Speed: "1.00MiB/s", Eta: "00:03"},
+		},
+		{
+			name: "playlist item with escaped title",
+			line: `[progressbar]{"id":"a1","title":"Café \"live\" | 50% off","playlist":"Concerts","playlistIndex":2,"playlistCount":12,` +
+				`"progress":{"status":"downloading","downloaded_bytes":512,"total_bytes":2048,"eta":3725,"speed":256.5}}`,
+			want: ProgressBar{Playlist: "Concerts", Playlist_index: 2, Playlist_count: 12, Title: `Café "live" | 50% off`,
+				VideoID: "a1", Status: "downloading", Progress: 0.25, DownloadedBytes: 512, TotalBytes: 2048,
+				BytesPerSecond: 256.5, EtaSeconds: 3725, Size: "2.00KiB", Speed: "256.50B/s", Eta: "01:02:05"},
+		},
+		{
+			// the "|" defaults of progressTemplate, used outside of playlists
+			name: "template defaults",
+			line: `[progressbar]{"id":"b2","title":"Clip","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"downloading","downloaded_bytes":100,"total_bytes":400,"eta":null,"speed":null}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Clip", VideoID: "b2", Status: "downloading",
+				Progress: 0.25, DownloadedBytes: 100, TotalBytes: 400, EtaSeconds: -1, Size: "400.00B"},
+		},
+		{
+			// playlist fields of a video in a playlist yt-dlp does not number
+			name: "null playlist fields",
+			line: `[progressbar]{"id":"c3","title":"Clip","playlist":null,"playlistIndex":null,"playlistCount":0,` +
+				`"progress":{"status":"downloading","downloaded_bytes":0}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Clip", VideoID: "c3", Status: "downloading",
+				EtaSeconds: -1},
+		},
+		{
+			name: "unknown size",
+			line: `[progressbar]{"id":"d4","title":"Live","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"downloading","downloaded_bytes":3145728,"speed":2097152.0,"eta":null,"elapsed":1.5}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Live", VideoID: "d4", Status: "downloading",
+				DownloadedBytes: 3145728, BytesPerSecond: 2097152, EtaSeconds: -1, Speed: "2.00MiB/s"},
+		},
+		{
+			name: "fragment download",
+			line: `[progressbar]{"id":"e5","title":"Stream","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"downloading","downloaded_bytes":1048576,"total_bytes_estimate":41943040.0,` +
+				`"fragment_index":3,"fragment_count":120,"eta":45,"speed":524288.0,"tmpfilename":"/media/download/stream.mp4.part"}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Stream", VideoID: "e5", Status: "downloading",
+				Progress: 0.025, DownloadedBytes: 1048576, TotalBytes: 41943040, BytesPerSecond: 524288, EtaSeconds: 45,
+				FragmentIndex: 3, FragmentCount: 120, Size: "40.00MiB", Speed: "512.00KiB/s", Eta: "00:45"},
+		},
+		{
+			name: "fragment download without estimate",
+			line: `[progressbar]{"id":"e6","title":"Stream","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"downloading","downloaded_bytes":1048576,"fragment_index":30,"fragment_count":120}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Stream", VideoID: "e6", Status: "downloading",
+				Progress: 0.25, DownloadedBytes: 1048576, EtaSeconds: -1, FragmentIndex: 30, FragmentCount: 120},
+		},
+		{
+			name: "finished",
+			line: `[progressbar]{"id":"f7","title":"Clip","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"finished","downloaded_bytes":4194304,"total_bytes":4194304,"elapsed":4.2,` +
+				`"filename":"/media/download/clip.mp4","_total_bytes_str":"   4.00MiB"}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Clip", VideoID: "f7", Status: "finished",
+				Progress: 1, DownloadedBytes: 4194304, TotalBytes: 4194304, EtaSeconds: -1, Size: "4.00MiB"},
+		},
+		{
+			// yt-dlp reports more bytes than announced for some servers
+			name: "more bytes than announced",
+			line: `[progressbar]{"id":"g8","title":"Clip","playlist":"","playlistIndex":1,"playlistCount":1,` +
+				`"progress":{"status":"downloading","downloaded_bytes":5000,"total_bytes":4000}}`,
+			want: ProgressBar{Playlist_index: 1, Playlist_count: 1, Title: "Clip", VideoID: "g8", Status: "downloading",
+				Progress: 1, DownloadedBytes: 5000, TotalBytes: 4000, EtaSeconds: -1, Size: "3.91KiB"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseProgressBar(test.line)
+			if err != nil {
+				t.Fatalf("ParseProgressBar: %v", err)
+			}
+			if *got != test.want {
+				t.Errorf("ParseProgressBar\n got %+v\nwant %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseProgressBarErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"missing prefix", `{"id":"a","title":"Clip","progress":{"status":"downloading"}}`, "not a progress line"},
+		{"default progress", `[download]  25.0% of    4.00MiB at    1.00MiB/s ETA 00:03`, "not a progress line"},
+		{"empty payload", `[progressbar]`, "invalid progress report"},
+		// a field missing in the info dict without a default is printed as NA
+		{"NA field", `[progressbar]{"id":NA,"title":"Clip","playlist":"","playlistIndex":1,"playlistCount":1,"progress":{}}`,
+			"invalid progress report"},
+		{"truncated", `[progressbar]{"id":"a","title":"Clip","progress":{"status":"downl`, "invalid progress report"},
+		{"empty title", `[progressbar]{"id":"a","title":"","playlist":"","playlistIndex":1,"playlistCount":1,"progress":{}}`,
+			"could not extract title"},
+		{"null title", `[progressbar]{"id":"a","title":null,"playlist":"","playlistIndex":1,"playlistCount":1,"progress":{}}`,
+			"could not extract title"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseProgressBar(test.line)
+			if err == nil {
+				t.Fatalf("ParseProgressBar returned %+v, want an error", *got)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ParseProgressBar error %q, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package downloader
+
+import "sync"
+
+// slotQueue limits the number of concurrent downloads of a domain. When a slot is freed
+// it is handed to the waiter with the highest priority, evaluated at that moment so that
+// priority changes of queued sessions take effect. Waiters of equal priority are served
+// in arrival order.
+type slotQueue struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+	waiters  []*slotWaiter
+}
+
+type slotWaiter struct {
+	priority func() int
+	ready    chan bool
+}
+
+func newSlotQueue(capacity int) *slotQueue {
+	return &slotQueue{capacity: capacity}
+}
+
+// Acquire blocks until a slot is available or stop is closed.
+// Returns false if stop was closed first, in which case no slot is held.
+func (q *slotQueue) Acquire(priority func() int, stop <-chan bool) bool {
+	q.mu.Lock()
+	if q.used < q.capacity && len(q.waiters) == 0 {
+		q.used++
+		q.mu.Unlock()
+		return true
+	}
+	waiter := &slotWaiter{priority: priority, ready: make(chan bool, 1)}
+	q.waiters = append(q.waiters, waiter)
+	q.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-stop:
+		q.mu.Lock()
+		for i, w := range q.waiters {
+			if w == waiter {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				q.mu.Unlock()
+				return false
+			}
+		}
+		q.mu.Unlock()
+		// the slot was granted concurrently, give it back
+		<-waiter.ready
+		q.Release()
+		return false
+	}
+}
+
+// take occupies a slot without waiting, even if none is free. It counts a download
+// which is already running against the queue.
+func (q *slotQueue) take() {
+	q.mu.Lock()
+	q.used++
+	q.mu.Unlock()
+}
+
+// Release frees a slot and hands it to the next waiter
+func (q *slotQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiters) == 0 || q.used > q.capacity {
+		// the queue was filled beyond its capacity by take, the waiters keep waiting
+		q.used--
+		return
+	}
+	next := 0
+	for i, w := range q.waiters {
+		if w.priority() > q.waiters[next].priority() {
+			next = i
+		}
+	}
+	waiter := q.waiters[next]
+	q.waiters = append(q.waiters[:next], q.waiters[next+1:]...)
+	waiter.ready <- true
+}
@@ -0,0 +1,196 @@
+// Automatic retry of failed downloads. A session failing with a retryable ErrorCode is
+// restarted on the same Downloader after an exponential backoff so that yt-dlp continues
+// from its .part files. Every run is recorded in the attempt history of the session.
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+)
+
+// RetryPolicy controls the automatic retries of a domain. In a per-domain policy,
+// zero values are taken from the default policy.
+type RetryPolicy struct {
+	MaxAttempts    int             `json:"maxAttempts,omitempty"`    // runs including the first one, 1 disables retries
+	InitialBackoff helper.Duration `json:"initialBackoff,omitempty"` // delay before the first retry
+	MaxBackoff     helper.Duration `json:"maxBackoff,omitempty"`     // upper bound of the delay
+	Multiplier     float64         `json:"multiplier,omitempty"`     // growth of the delay per retry
+	Jitter         float64         `json:"jitter,omitempty"`         // random fraction between 0 and 1 added to or removed from the delay
+}
+
+// DefaultRetryPolicy returns the policy used for domains without their own policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: helper.Duration{Duration: 10 * time.Second},
+		MaxBackoff:     helper.Duration{Duration: 5 * time.Minute},
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Validate reports the first invalid setting. Zero values are accepted when partial is set.
+func (p RetryPolicy) Validate(partial bool) error {
+	if p.MaxAttempts < 0 || (!partial && p.MaxAttempts < 1) {
+		return fmt.Errorf("maxAttempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.InitialBackoff.Duration < 0 || (!partial && p.InitialBackoff.Duration <= 0) {
+		return fmt.Errorf("initialBackoff must be positive, got %s", p.InitialBackoff)
+	}
+	if p.MaxBackoff.Duration < 0 || (!partial && p.MaxBackoff.Duration < p.InitialBackoff.Duration) {
+		return fmt.Errorf("maxBackoff must not be shorter than initialBackoff, got %s", p.MaxBackoff)
+	}
+	if p.Multiplier < 0 || (!partial && p.Multiplier < 1) {
+		return fmt.Errorf("multiplier must be at least 1, got %g", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1, got %g", p.Jitter)
+	}
+	return nil
+}
+
+// inherit fills the zero values of p from base
+func (p RetryPolicy) inherit(base RetryPolicy) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = base.MaxAttempts
+	}
+	if p.InitialBackoff.Duration == 0 {
+		p.InitialBackoff = base.InitialBackoff
+	}
+	if p.MaxBackoff.Duration == 0 {
+		p.MaxBackoff = base.MaxBackoff
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = base.Multiplier
+	}
+	if p.Jitter == 0 {
+		p.Jitter = base.Jitter
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry, counted from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := float64(p.InitialBackoff.Duration) * math.Pow(p.Multiplier, float64(retry-1))
+	delay = math.Min(delay, float64(p.MaxBackoff.Duration))
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// retryPolicy returns the policy of a host. A domain policy also applies to its subdomains,
+// the most specific domain wins.
+func (c *Config) retryPolicy(host string) RetryPolicy {
+	host = strings.ToLower(host)
+	best := ""
+	policy := c.Retry
+	for domain, domainPolicy := range c.DomainRetry {
+		domain = strings.ToLower(domain)
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(best) {
+			best = domain
+			policy = domainPolicy.inherit(c.Retry)
+		}
+	}
+	return policy
+}
+
+// Attempt records one run of yt-dlp for a session
+type Attempt struct {
+	Number       int                           `json:"number"`
+	StartTime    helper.TimeWithoutNanoseconds `json:"startTime"`
+	FinishTime   helper.TimeWithoutNanoseconds `json:"finishTime"`
+	Status       Status                        `json:"status"` // status of the session at the end of the run
+	ErrorCode    ErrorCode                     `json:"errorCode,omitempty"`
+	ErrorMessage string                        `json:"errorMessage,omitempty"`
+}
+
+// beginAttempt adds a new entry to the attempt history
+func (s *Session) beginAttempt() {
+	s.mu.Lock()
+	s.Attempts = append(s.Attempts, Attempt{
+		Number:    len(s.Attempts) + 1,
+		StartTime: helper.TimeWithoutNanoseconds{Time: time.Now()},
+	})
+	s.NextRetry = nil
+	s.mu.Unlock()
+	s.notify()
+}
+
+// endAttempt records the outcome of the current attempt
+func (s *Session) endAttempt() {
+	s.mu.Lock()
+	if len(s.Attempts) > 0 {
+		attempt := &s.Attempts[len(s.Attempts)-1]
+		attempt.FinishTime = helper.TimeWithoutNanoseconds{Time: time.Now()}
+		attempt.Status = s.Status
+		attempt.ErrorCode = s.ErrorCode
+		attempt.ErrorMessage = s.ErrorMessage
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// scheduleRetry puts a failed session into the retry state until the given time
+func (s *Session) scheduleRetry(at time.Time) {
+	s.mu.Lock()
+	s.state = STATE_RETRY_WAIT
+	s.updateStatus()
+	s.NextRetry = &helper.TimeWithoutNanoseconds{Time: at}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// failure returns the error code of a session in the error state
+func (s *Session) failure() (ErrorCode, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ErrorCode, s.state == STATE_ERROR
+}
+
+// downloadFinished is called when a run of a Downloader ends. A retryable failure is
+// retried after the backoff of the retry policy of the domain.
+func (dm *DownloadManager) downloadFinished(d *Downloader) {
+	session := d.session()
+	code, failed := session.failure()
+	if !failed || !code.Retryable() || !dm.isRegistered(d.shaKey) || dm.IsShuttingDown() {
+		return
+	}
+	policy := dm.config.retryPolicy(d.host)
+	d.mu.Lock()
+	if d.active || d.retries+1 >= policy.MaxAttempts {
+		d.mu.Unlock()
+		return
+	}
+	d.retries++
+	retries := d.retries
+	d.mu.Unlock()
+
+	delay := policy.backoff(retries)
+	session.scheduleRetry(time.Now().Add(delay))
+	session.logger().Info("download failed, retrying", "code", code, "retry", retries, "delay", delay.Round(time.Second))
+	session.toolLog.WriteLine(LOGSOURCE_SERVER, fmt.Sprintf("retry %d scheduled in %s after %s", retries, delay.Round(time.Second), code))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active {
+		// restarted by the user in the meantime
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		if d.retryTimer != timer {
+			// paused, canceled or restarted in the meantime
+			d.mu.Unlock()
+			return
+		}
+		d.retryTimer = nil
+		d.mu.Unlock()
+		d.start(true)
+	})
+	d.retryTimer = timer
+}
@@ -5,14 +5,17 @@ package downloader
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
@@ -36,6 +39,8 @@ const (
 	STATE_CANCELED
 	STATE_PAUSED
 	STATE_ERROR
+	STATE_RETRY_WAIT    // failed and waiting for an automatic retry
+	STATE_EXTRACT_AUDIO // the audio of an audio-only download is extracted, appended to keep saved states valid
 )
 
 type Status string
@@ -47,6 +52,7 @@ const (
 	STATUS_CANCELED    Status = "canceled"
 	STATUS_PAUSED      Status = "paused"
 	STATUS_ERROR       Status = "error"
+	STATUS_RETRYING    Status = "retrying"
 )
 
 type StdOutContains string
@@ -62,31 +68,56 @@ const (
 	STDOUT_DOWNLOAD_COMPLETED            StdOutContains = "[download] Download completed"
 	STDOUT_WRITE_VIDEO_JSON_METADATA     StdOutContains = "[info] Writing video metadata as JSON to"
 	STDOUT_REMUX                         StdOutContains = "[VideoRemuxer]"
+	STDOUT_CONVERT                       StdOutContains = "[VideoConvertor]"
+	STDOUT_EXTRACT_AUDIO                 StdOutContains = "[ExtractAudio]"
 	STDOUT_MERGER                        StdOutContains = "[Merger] Merging formats"
 	STDOUT_DELETE_PARTS                  StdOutContains = "Deleting original file"
 	STDOUT_PLAYLIST_COMPLETE             StdOutContains = "[download] Finished downloading playlist"
 )
 
+// Session is shared between the goroutine parsing yt-dlp output, the ffmpeg goroutines and
+// HTTP handlers. All fields are guarded by mu, use Snapshot to obtain a consistent copy.
 type Session struct {
-	ID             string                        `json:"id"` // the same ID as the SHA key
-	StartTime      helper.TimeWithoutNanoseconds `json:"startTime"`
-	FinishTime     helper.TimeWithoutNanoseconds `json:"finishTime"`
-	URL            string                        `json:"urlraw"`
-	state          State                         `json:"-"`
-	Status         Status                        `json:"status"`
-	Title          string                        `json:"title"` // playlist title or video title depending on the download type
-	Playlist_count int                           `json:"playlistCount"`
-	Playlist_seq   int                           `json:"playlistIndex"`
-	IsPlaylist     bool                          `json:"isPlaylist"`
-	Videos         []*Video                      `json:"videos,omitempty"` // one entry for video and multiple for playlist
-	currentVideo   *Video                        `json:"-"`
-	ffmpegQueue    chan bool                     `json:"-"`
-	ffmpegWg       *sync.WaitGroup               `json:"-"`
-	sessionPID     int                           `json:"-"`
+	mu              sync.RWMutex
+	ID              string                         `json:"id"` // the same ID as the SHA key
+	StartTime       helper.TimeWithoutNanoseconds  `json:"startTime"`
+	FinishTime      helper.TimeWithoutNanoseconds  `json:"finishTime"`
+	URL             string                         `json:"urlraw"`
+	state           State                          `json:"-"`
+	Status          Status                         `json:"status"`
+	Title           string                         `json:"title"` // playlist title or video title depending on the download type
+	Playlist_count  int                            `json:"playlistCount"`
+	Playlist_seq    int                            `json:"playlistIndex"`
+	IsPlaylist      bool                           `json:"isPlaylist"`
+	Options         SessionOptions                 `json:"options"`
+	Owners          []string                       `json:"owners,omitempty"`       // users who requested the URL, empty for sessions created without authentication
+	ErrorCode       ErrorCode                      `json:"errorCode,omitempty"`    // category of the failure in the error state
+	ErrorMessage    string                         `json:"errorMessage,omitempty"` // description of the failure as reported by the tool
+	Attempts        []Attempt                      `json:"attempts,omitempty"`     // runs of yt-dlp, the last one is the current run
+	NextRetry       *helper.TimeWithoutNanoseconds `json:"nextRetry,omitempty"`    // time of the automatic retry in the retrying state
+	Stalls          int                            `json:"stalls,omitempty"`       // processes terminated by the watchdog
+	LastStall       *helper.TimeWithoutNanoseconds `json:"lastStall,omitempty"`    // time of the last stall
+	OverallProgress float64                        `json:"overallProgress"`        // 0 to 1 across all videos, computed by Snapshot
+	BytesDownloaded int64                          `json:"bytesDownloaded"`
+	BytesTotal      int64                          `json:"bytesTotal"`       // sum of the known video sizes
+	Videos          []*Video                       `json:"videos,omitempty"` // one entry for video and multiple for playlist
+	currentVideo    *Video                         `json:"-"`
+	videoCursor     int                            `json:"-"` // number of videos announced by the running yt-dlp
+	inSubtitle      bool                           `json:"-"` // yt-dlp is downloading a subtitle file, its output is skipped
+	ffmpegQueue     chan bool                      `json:"-"`
+	ffmpegWg        *sync.WaitGroup                `json:"-"`
+	runner          ToolRunner                     `json:"-"`
+	config          *Config                        `json:"-"`
+	ffmpegProcess   Process                        `json:"-"` // the running ffmpeg process, nil if not running
+	interrupted     bool                           `json:"-"` // conversions were stopped by Shutdown
+	toolLog         *sessionLog                    `json:"-"` // output of yt-dlp and ffmpeg, nil if disabled
+	onChange        postSession                    `json:"-"` // called after state changes
+	onProgress      postSession                    `json:"-"` // called after progress updates
 }
 
 func NewSession(id string, urlstring string, ffmpegQueue chan bool,
 	ffmpegWg *sync.WaitGroup) *Session {
+	config := DefaultConfig()
 	return &Session{
 		ID:             id,
 		StartTime:      helper.TimeWithoutNanoseconds{Time: time.Now()},
@@ -101,18 +132,134 @@ func NewSession(id string, urlstring string, ffmpegQueue chan bool,
 		currentVideo:   nil,
 		ffmpegQueue:    ffmpegQueue,
 		ffmpegWg:       ffmpegWg,
-		sessionPID:     -1,
+		config:         &config,
 	}
 }
 
 func (session *Session) GetSessionStatusString() string {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
 	return string(session.Status)
 }
 
+// Snapshot returns a deep copy of the session that can be safely encoded
+// while the download is in progress
+func (s *Session) Snapshot() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := &Session{
+		ID:             s.ID,
+		StartTime:      s.StartTime,
+		FinishTime:     s.FinishTime,
+		URL:            s.URL,
+		state:          s.state,
+		Status:         s.Status,
+		Title:          s.Title,
+		Playlist_count: s.Playlist_count,
+		Playlist_seq:   s.Playlist_seq,
+		IsPlaylist:     s.IsPlaylist,
+		Options:        s.Options,
+		Owners:         append([]string(nil), s.Owners...),
+		ErrorCode:      s.ErrorCode,
+		ErrorMessage:   s.ErrorMessage,
+		Attempts:       append([]Attempt(nil), s.Attempts...),
+		NextRetry:      s.NextRetry,
+		Stalls:         s.Stalls,
+		LastStall:      s.LastStall,
+		Videos:         make([]*Video, 0, len(s.Videos)),
+	}
+	for _, video := range s.Videos {
+		snapshot.Videos = append(snapshot.Videos, video.clone())
+	}
+	snapshot.aggregateProgress()
+	return snapshot
+}
+
+// aggregateProgress computes the overall progress of the session. Every item of a
+// playlist has the same weight, items which have not started yet count as 0.
+func (s *Session) aggregateProgress() {
+	s.BytesDownloaded, s.BytesTotal = 0, 0
+	progress := 0.0
+	for _, video := range s.Videos {
+		video.aggregateProgress()
+		s.BytesDownloaded += video.BytesDownloaded
+		s.BytesTotal += video.BytesTotal
+		progress += video.OverallProgress
+	}
+	items := len(s.Videos)
+	if s.IsPlaylist && s.Playlist_count > items {
+		items = s.Playlist_count
+	}
+	switch {
+	case s.state == STATE_SESSION_COMPLETE:
+		s.OverallProgress = 1
+	case items > 0:
+		s.OverallProgress = progress / float64(items)
+	default:
+		s.OverallProgress = 0
+	}
+}
+
+// currentState returns the state of the parser
+func (s *Session) currentState() State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// setState moves the session into a new state and notifies the owner
+func (s *Session) setState(state State) {
+	s.mu.Lock()
+	s.state = state
+	s.updateStatus()
+	if state == STATE_SESSION_COMPLETE {
+		s.FinishTime = helper.TimeWithoutNanoseconds{Time: time.Now()}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// fail puts the session into the error state. The video being processed, if it is not
+// complete yet, fails with the same error.
+func (s *Session) fail(toolErr *ToolError) {
+	s.mu.Lock()
+	s.state = STATE_ERROR
+	s.ErrorCode = toolErr.Code
+	s.ErrorMessage = toolErr.Message
+	if s.currentVideo != nil && s.currentVideo.Status != VIDEOSTATUS_COMPLETED {
+		s.currentVideo.fail(toolErr)
+	}
+	s.updateStatus()
+	s.mu.Unlock()
+	s.notify()
+}
+
+// notify reports a change of the session to its owner, e.g. for persisting it.
+// It must be called without holding mu.
+func (s *Session) notify() {
+	if s.onChange != nil {
+		s.onChange(s)
+	}
+}
+
+// notifyProgress reports a minor change, such as a progress update, to the owner.
+// It must be called without holding mu.
+func (s *Session) notifyProgress() {
+	if s.onProgress != nil {
+		s.onProgress(s)
+	}
+}
+
 func (s *Session) Parse(m string) error {
+	s.mu.Lock()
 	var err error = nil
-	fmt.Printf("DEBUG: yt-dlp returns %v\n", m)
-	fmt.Printf("DEBUG: current state %v\n", s.state)
+	var convert *Video // the video handed over to HLS conversion, probed once mu is released
+	previousState := s.state
+	s.logger().Debug("yt-dlp output", "line", m, "state", s.state)
+	if s.skipSubtitleOutput(m) {
+		s.mu.Unlock()
+		return nil
+	}
 	switch s.state {
 	case STATE_WAIT:
 		if strings.HasPrefix(m, string(STDOUT_PLAYLIST_TITLE)) {
@@ -131,21 +278,7 @@ func (s *Session) Parse(m string) error {
 		}
 	case STATE_PLAYLIST_TITLE:
 		if strings.Contains(m, string(STDOUT_PLAYLIST_SEQ)) {
-			reg, err := regexp.Compile("dwnloading item (\\d+) of (\\d+)")
-			if err == nil {
-				match := reg.FindStringSubmatch(m)
-				if match != nil {
-					if val, err := strconv.Atoi(strings.TrimSpace(match[1])); err == nil {
-						s.Playlist_seq = val
-					}
-					if val, err := strconv.Atoi(strings.TrimSpace(match[2])); err == nil {
-						s.Playlist_count = val
-					}
-
-				} else {
-					err = errors.New("failed to extract playlist sequence")
-				}
-			}
+			s.extractPlaylistSeq(m)
 			s.state = STATE_PLAYLIST_SEQ
 		} else {
 			err = errors.New("did not get message announcing playlist sequence")
@@ -165,7 +298,8 @@ func (s *Session) Parse(m string) error {
 		if strings.Contains(m, string(STDOUT_DOWNLOAD_DESTINATION)) ||
 			strings.Contains(m, string(STDOUT_DOWNLOAD_PREVIOUSLY_COMPLETED)) {
 			s.currentVideo.AddSubstream()
-			fmt.Printf("Adding substream %d\n", s.currentVideo.currentSubstream.Index)
+			s.currentVideo.recordDestination(m)
+			s.videoLogger(s.currentVideo).Debug("adding substream", "substream", s.currentVideo.currentSubstream.Index)
 			s.state = STATE_DOWNLOAD_START
 		} else if strings.Contains(m, string(STDOUT_DOWNLOAD_RESUMING)) {
 			s.state = STATE_DOWNLOAD_RESUME
@@ -175,7 +309,8 @@ func (s *Session) Parse(m string) error {
 	case STATE_DOWNLOAD_RESUME:
 		if strings.Contains(m, string(STDOUT_DOWNLOAD_DESTINATION)) {
 			s.currentVideo.AddSubstream()
-			fmt.Printf("Adding substream %d\n", s.currentVideo.currentSubstream.Index)
+			s.currentVideo.recordDestination(m)
+			s.videoLogger(s.currentVideo).Debug("adding substream", "substream", s.currentVideo.currentSubstream.Index)
 			s.state = STATE_DOWNLOAD_START
 		} else {
 			err = errors.New("error when starting to download")
@@ -188,10 +323,14 @@ func (s *Session) Parse(m string) error {
 			if s.IsPlaylist == false {
 				s.Title = s.currentVideo.Title
 			}
-		} else if strings.Contains(m, string(STDOUT_REMUX)) {
+		} else if isRemuxMessage(m) {
 			s.extractFileLocation(m)
 			s.state = STATE_REMUX
 			s.currentVideo.Status = VIDEOSTATUS_REMUXING
+		} else if strings.Contains(m, string(STDOUT_EXTRACT_AUDIO)) {
+			s.extractAudioLocation(m)
+			s.state = STATE_EXTRACT_AUDIO
+			s.currentVideo.Status = VIDEOSTATUS_EXTRACTING_AUDIO
 		} else {
 			err = errors.New("failed to get progress bar")
 		}
@@ -209,73 +348,118 @@ func (s *Session) Parse(m string) error {
 			strings.Contains(m, string(STDOUT_DOWNLOAD_PREVIOUSLY_COMPLETED)) {
 			s.state = STATE_DOWNLOAD_START
 			s.currentVideo.AddSubstream()
+			s.currentVideo.recordDestination(m)
+		} else if strings.Contains(m, string(STDOUT_DOWNLOAD_RESUMING)) {
+			s.state = STATE_DOWNLOAD_RESUME
 		} else if strings.Contains(m, string(STDOUT_MERGER)) {
 			s.state = STATE_MERGE
 			s.currentVideo.Status = VIDEOSTATUS_MERGING
 
-		} else if strings.Contains(m, string(STDOUT_REMUX)) {
+		} else if isRemuxMessage(m) {
 			s.extractFileLocation(m)
 			s.state = STATE_REMUX
 			s.currentVideo.Status = VIDEOSTATUS_REMUXING
+		} else if strings.Contains(m, string(STDOUT_EXTRACT_AUDIO)) {
+			s.extractAudioLocation(m)
+			s.state = STATE_EXTRACT_AUDIO
+			s.currentVideo.Status = VIDEOSTATUS_EXTRACTING_AUDIO
 		} else {
 			err = errors.New("download completed but did not move to the next step")
 		}
 
 	case STATE_MERGE:
-		if strings.Contains(m, string(STDOUT_REMUX)) {
+		if isRemuxMessage(m) {
 			s.extractFileLocation(m)
 			s.state = STATE_REMUX
 			s.currentVideo.Status = VIDEOSTATUS_REMUXING
 		} else {
 			err = errors.New("did not receive VideoRemuxer message")
 		}
-	case STATE_REMUX:
+	case STATE_REMUX, STATE_EXTRACT_AUDIO:
 		/*
 			While in this state, we can expect 3 situations
 			1. about to download the next video in a playlist
 			2. the playlist is completed
 			3. yt-dlp exits without error
-			In all cases, the current video struct is handed over to HLS conversion process
+			In all cases, the current video struct is handed over to HLS conversion process.
+			The remux configured for videos may also run on extracted audio.
 		*/
-		if strings.Contains(m, string(STDOUT_PLAYLIST_SEQ)) {
+		if s.state == STATE_EXTRACT_AUDIO && isRemuxMessage(m) {
+			s.extractFileLocation(m)
+			s.state = STATE_REMUX
+			s.currentVideo.Status = VIDEOSTATUS_REMUXING
+		} else if strings.Contains(m, string(STDOUT_PLAYLIST_SEQ)) {
+			s.extractPlaylistSeq(m)
 			s.state = STATE_PLAYLIST_SEQ
-			s.GetFileSpecs()
 			// Start HLS conversion on the last video
-			err := s.SetupHLSConversion()
-			if err != nil {
-				err = fmt.Errorf("error when starting HLS conversion %w", err)
-			}
+			convert = s.currentVideo
 		} else if s.IsPlaylist && strings.Contains(m, string(STDOUT_PLAYLIST_COMPLETE)) {
-			s.GetFileSpecs()
 			s.state = STATE_HLS_CONVERSION
-			err := s.SetupHLSConversion()
-			if err != nil {
-				err = fmt.Errorf("error when starting HLS conversion %w", err)
-			}
+			convert = s.currentVideo
 		} else {
-			err = errors.New("extraneous stdout after Remux")
+			err = errors.New("extraneous stdout after Remux or ExtractAudio")
 		}
 	default:
 		err = errors.New("illegal state")
 	}
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+		s.videoLogger(s.currentVideo).Warn("unexpected yt-dlp output", "line", m, "error", err)
 		s.state = STATE_ERROR
 	}
 	s.updateStatus()
+	if s.Options.Title != "" {
+		s.Title = s.Options.Title
+	}
+	changed := s.state != previousState
+	s.mu.Unlock()
+	if changed {
+		s.notify()
+	} else {
+		s.notifyProgress()
+	}
+	if convert != nil {
+		if convertErr := s.convert(convert); convertErr != nil {
+			err = fmt.Errorf("error when starting HLS conversion %w", convertErr)
+		}
+	}
 
 	return err
 
 }
 
+// subtitleExtensions are the formats of the subtitle files written by --write-subs
+var subtitleExtensions = []string{".vtt", ".srt", ".ass", ".ssa", ".ttml", ".dfxp", ".lrc", ".json3", ".srv1", ".srv2", ".srv3"}
+
+// skipSubtitleOutput reports whether m belongs to the download of a subtitle file, which
+// yt-dlp announces with a destination and progress like a media stream. The download
+// ends with the next line of another kind. s.mu must be held.
+func (s *Session) skipSubtitleOutput(m string) bool {
+	if _, destination, ok := strings.Cut(m, string(STDOUT_DOWNLOAD_DESTINATION)); ok {
+		s.inSubtitle = slices.Contains(subtitleExtensions, strings.ToLower(filepath.Ext(strings.TrimSpace(destination))))
+		return s.inSubtitle
+	}
+	if s.inSubtitle && (strings.HasPrefix(m, string(STDOUT_DOWNLOAD_IN_PROGRESS)) ||
+		strings.HasPrefix(m, string(STDOUT_DOWNLOAD_COMPLETED))) {
+		return true
+	}
+	s.inSubtitle = false
+	return false
+}
+
+// isRemuxMessage reports whether m announces the final container of a video, written by
+// --remux-video or, for webm, by --recode-video
+func isRemuxMessage(m string) bool {
+	return strings.Contains(m, string(STDOUT_REMUX)) || strings.Contains(m, string(STDOUT_CONVERT))
+}
+
 func (s *Session) extractFileLocation(m string) {
-	if strings.Contains(m, "Not remuxing") {
+	if strings.Contains(m, "Not remuxing") || strings.Contains(m, "Not converting") {
 		reg := regexp.MustCompile("\"(.+)\"")
 		if match := reg.FindStringSubmatch(m); match != nil {
 			s.currentVideo.FileLocation = match[1]
 		}
 
-	} else if strings.Contains(m, "Remuxing video") {
+	} else if strings.Contains(m, "Remuxing video") || strings.Contains(m, "Converting video") {
 		reg := regexp.MustCompile("Destination: (.+)")
 		if match := reg.FindStringSubmatch(m); match != nil {
 			s.currentVideo.FileLocation = match[1]
@@ -283,6 +467,18 @@ func (s *Session) extractFileLocation(m string) {
 	}
 }
 
+// extractAudioLocation reads the file written by the ExtractAudio post-processor, either
+// "Destination: <file>" or "Not converting audio <file>; file is already in target format ..."
+func (s *Session) extractAudioLocation(m string) {
+	if _, destination, ok := strings.Cut(m, "Destination: "); ok {
+		s.currentVideo.FileLocation = destination
+	} else if _, rest, ok := strings.Cut(m, "Not converting audio "); ok {
+		if i := strings.LastIndex(rest, "; file is already"); i >= 0 {
+			s.currentVideo.FileLocation = rest[:i]
+		}
+	}
+}
+
 func (s *Session) updateStatus() {
 	switch s.state {
 	case STATE_WAIT:
@@ -295,6 +491,7 @@ func (s *Session) updateStatus() {
 		STATE_DOWNLOAD_COMPLETE,
 		STATE_MERGE,
 		STATE_REMUX,
+		STATE_EXTRACT_AUDIO,
 		STATE_HLS_CONVERSION:
 		s.Status = STATUS_DOWNLOADING
 	case STATE_CANCELED:
@@ -305,87 +502,324 @@ func (s *Session) updateStatus() {
 		s.Status = STATUS_PAUSED
 	case STATE_ERROR:
 		s.Status = STATUS_ERROR
+	case STATE_RETRY_WAIT:
+		s.Status = STATUS_RETRYING
 	}
 }
 
+// extractPlaylistSeq reads the playlist position from a "Downloading item N of M" message
+func (s *Session) extractPlaylistSeq(m string) {
+	reg := regexp.MustCompile(`Downloading item (\d+) of (\d+)`)
+	if match := reg.FindStringSubmatch(m); match != nil {
+		if val, err := strconv.Atoi(strings.TrimSpace(match[1])); err == nil {
+			s.Playlist_seq = val
+		}
+		if val, err := strconv.Atoi(strings.TrimSpace(match[2])); err == nil {
+			s.Playlist_count = val
+		}
+	}
+}
+
+// addNewVideoToSession moves on to the next video. When a session is resumed, yt-dlp
+// announces every video again and the videos recorded earlier are reused.
 func (s *Session) addNewVideoToSession() {
-	s.currentVideo = NewVideo()
-	s.Videos = append(s.Videos, s.currentVideo)
+	if s.videoCursor < len(s.Videos) {
+		s.currentVideo = s.Videos[s.videoCursor]
+		s.currentVideo.substreamCount = 0
+	} else {
+		s.currentVideo = NewVideo()
+		s.Videos = append(s.Videos, s.currentVideo)
+	}
+	s.videoCursor += 1
+}
+
+// prepareRun resets the parser before a new run of yt-dlp, keeping the videos of previous runs
+func (s *Session) prepareRun(ffmpegWg *sync.WaitGroup) {
+	s.mu.Lock()
+	s.ffmpegWg = ffmpegWg
+	s.videoCursor = 0
+	s.state = STATE_WAIT
+	s.interrupted = false
+	s.ErrorCode = ""
+	s.ErrorMessage = ""
+	s.updateStatus()
+	s.mu.Unlock()
+	s.notify()
+}
+
+// pause puts the session into the paused state after yt-dlp was stopped.
+// Videos which are already downloaded keep their status.
+func (s *Session) pause() {
+	s.mu.Lock()
+	s.state = STATE_PAUSED
+	s.updateStatus()
+	for _, video := range s.Videos {
+		switch video.Status {
+		case VIDEOSTATUS_NEWVIDEO, VIDEOSTATUS_DOWNLOADING, VIDEOSTATUS_MERGING, VIDEOSTATUS_REMUXING,
+			VIDEOSTATUS_EXTRACTING_AUDIO:
+			video.Status = VIDEOSTATUS_PAUSED
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// removePartialFiles deletes the .part and .ytdl files yt-dlp keeps for resuming the
+// downloads of the session. Only files below the download root are touched.
+func (s *Session) removePartialFiles() ([]string, error) {
+	s.mu.RLock()
+	candidates := make([]string, 0)
+	for _, video := range s.Videos {
+		for _, substream := range video.SubStream {
+			if substream.Destination == "" || !isWithin(s.config.DownloadRoot, substream.Destination) {
+				continue
+			}
+			// fragmented downloads add .part-Frag<n> files next to the .part file
+			parts, _ := filepath.Glob(substream.Destination + ".part*")
+			candidates = append(candidates, parts...)
+			candidates = append(candidates, substream.Destination+".ytdl")
+		}
+	}
+	s.mu.RUnlock()
+
+	removed := make([]string, 0)
+	var firstErr error
+	for _, path := range candidates {
+		err := os.Remove(path)
+		switch {
+		case err == nil:
+			removed = append(removed, path)
+		case errors.Is(err, fs.ErrNotExist):
+		case firstErr == nil:
+			firstErr = fmt.Errorf("unable to remove %s %w", path, err)
+		}
+	}
+	if len(removed) > 0 {
+		s.logger().Debug("removed partial files", "files", removed)
+	}
+	return removed, firstErr
+}
+
+// isWithin reports whether path is located below dir
+func isWithin(dir string, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
+// hlsAudioEncoders maps the codecs of audio-only HLS renditions to the ffmpeg encoder settings
+var hlsAudioEncoders = map[string][]string{
+	"aac":  {"-c:a", "aac", "-b:a", "192k"},
+	"opus": {"-c:a", "libopus", "-b:a", "128k"},
+}
+
+// hlsArgs returns the ffmpeg arguments converting input into the playlist output, and the
+// playlist the video is played from. A video is encoded into the renditions of the ladder
+// when one is given, the playlist is then the master playlist next to output. An audio-only
+// download is converted into a single audio rendition with fragmented MP4 segments.
+func (s *Session) hlsArgs(input string, output string, audioOnly bool, ladder []Rendition, hasAudio bool) ([]string, string) {
+	if !audioOnly && len(ladder) > 0 {
+		folder := filepath.Dir(output)
+		return s.config.ladderArgs(input, folder, ladder, hasAudio), filepath.Join(folder, masterPlaylistName)
+	}
+	args := []string{"-i", input}
+	if audioOnly {
+		args = append(args, "-map", "0:a:0")
+		args = append(args, hlsAudioEncoders[s.config.HLSAudioCodec]...)
+		args = append(args, "-hls_segment_type", "fmp4")
+	}
+	return append(args, "-start_number", "0",
+		"-hls_time", s.config.hlsSegmentSeconds(), "-hls_list_size", "0", "-f", "hls", output, "-loglevel", "info", "-nostats",
+		"-progress", "pipe:1"), output
 }
 
 // StartHLSConversion invokes ffmpeg to convert any video into the hls format suitable for streaming
-func StartHLSConversion(input string, output string, video *Video, pid *int) error {
-	defer func() { *pid = -1 }()
+func (s *Session) StartHLSConversion(input string, output string, video *Video) error {
+	defer func() {
+		s.mu.Lock()
+		s.ffmpegProcess = nil
+		s.mu.Unlock()
+	}()
 	if video == nil {
-		fmt.Println("The video does not exist")
 		return errors.New("the video does not exist")
 	}
-	cmd := exec.Command("ffmpeg", "-i", input, "-start_number", "0",
-		"-hls_time", "10", "-hls_list_size", "0", "-f", "hls", output, "-loglevel", "error")
-	fmt.Println("Debug: ", cmd.String())
-	err := cmd.Start()
+	s.mu.RLock()
+	log := s.videoLogger(video)
+	audioOnly := s.Options.AudioOnly
+	ladder := s.config.ladderFor(video.Resolution)
+	s.mu.RUnlock()
+	// the renditions of a ladder map the audio stream explicitly, which fails without one
+	hasAudio := audioOnly || len(ladder) == 0 || HasAudioStream(s.runner, input)
+	args, playlist := s.hlsArgs(input, output, audioOnly, ladder, hasAudio)
+	log.Debug("starting ffmpeg", "args", strings.Join(args, " "))
+	process, err := s.runner.Start(TOOL_FFMPEG, args...)
 	if err != nil {
+		s.mu.Lock()
+		video.fail(&ToolError{Code: ERRCODE_FFMPEG_FAILED, Message: err.Error(), Err: err})
+		s.mu.Unlock()
 		return fmt.Errorf("error when starting ffmpeg %w", err)
 	} else {
-		*pid = cmd.Process.Pid
+		s.mu.Lock()
+		s.ffmpegProcess = process
+		s.mu.Unlock()
 	}
 
-	err = cmd.Wait()
-
+	s.toolLog.WriteLine(LOGSOURCE_SERVER, "starting ffmpeg "+strings.Join(args, " "))
+	var stalled atomic.Bool
+	timeout := s.config.StallTimeout.Duration
+	watch := newWatchdog(timeout, func() {
+		stalled.Store(true)
+		log.Warn("ffmpeg stalled, terminating", "timeout", timeout)
+		s.toolLog.WriteLine(LOGSOURCE_SERVER, fmt.Sprintf("no progress for %s, terminating ffmpeg", timeout))
+		s.markStall()
+		terminateProcess(process, terminateGracePeriod)
+	})
+	defer watch.Stop()
+
+	stderrErrors := &errorCollector{}
+	stderrDone := make(chan bool)
+	go func() {
+		s.toolLog.Copy(LOGSOURCE_FFMPEG_STDERR, process.Stderr(), stderrErrors.observe)
+		close(stderrDone)
+	}()
+	watchFFmpegProgress(process.Stdout(), watch)
+	<-stderrDone
+	err = process.Wait()
+	watch.Stop()
 	if err != nil {
-		video.Status = VIDEOSTATUS_ERROR
-		fmt.Printf("error during HLS conversio %s", err.Error())
-		return fmt.Errorf("error during HLS conversio %w", err)
-	} else {
-		fmt.Printf("Conversion to HLS completed, stored at %s\n", output)
-		unescapedPath := strings.TrimPrefix(output, "/media/hls")
-		pathComponents := strings.Split(unescapedPath, "/")
+		s.toolLog.WriteLine(LOGSOURCE_SERVER, "ffmpeg exited with "+err.Error())
+	}
+	cover := ""
+	if err == nil && audioOnly {
+		cover = extractCoverArt(s.runner, input, filepath.Dir(output))
+	}
 
-		for i, component := range pathComponents {
-			pathComponents[i] = url.PathEscape(component)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && s.interrupted {
+		video.Status = VIDEOSTATUS_PAUSED
+		log.Info("HLS conversion interrupted")
+		return errConversionInterrupted
+	} else if err != nil {
+		toolErr := stderrErrors.result(err, ERRCODE_FFMPEG_FAILED)
+		if stalled.Load() {
+			toolErr = &ToolError{Code: ERRCODE_STALLED, Message: fmt.Sprintf("ffmpeg made no progress for %s", timeout), Err: err}
+		}
+		video.fail(toolErr)
+		log.Error("HLS conversion failed", "code", toolErr.Code, "error", toolErr.Message)
+		return fmt.Errorf("error during HLS conversion %w", toolErr)
+	} else {
+		log.Info("HLS conversion completed", "output", playlist)
+		video.StreamURL = s.hlsURL(playlist)
+		if cover != "" {
+			video.CoverURL = s.hlsURL(cover)
 		}
-		encodedPath := strings.Join(pathComponents, "/")
-		video.StreamURL = encodedPath
 		video.Status = VIDEOSTATUS_COMPLETED
+		video.ErrorCode = ""
+		video.ErrorMessage = ""
 
 		return nil
 	}
 }
 
+// hlsURL returns the escaped path of a file below the HLS root
+func (s *Session) hlsURL(path string) string {
+	unescapedPath := strings.TrimPrefix(path, s.config.HLSRoot)
+	pathComponents := strings.Split(unescapedPath, "/")
+
+	for i, component := range pathComponents {
+		pathComponents[i] = url.PathEscape(component)
+	}
+	return strings.Join(pathComponents, "/")
+}
+
+// extractCoverArt writes the cover art embedded in an audio file into folder.
+// Returns the path of the image, or "" if the file has none.
+func extractCoverArt(runner ToolRunner, input string, folder string) string {
+	cover := filepath.Join(folder, "cover.jpg")
+	_, err := runTool(runner, TOOL_FFMPEG, "-y", "-i", input, "-map", "0:v:0", "-frames:v", "1", "-loglevel", "error", cover)
+	if err != nil {
+		slog.Warn("unable to extract the cover art", "input", input, "error", err)
+		return ""
+	}
+	return cover
+}
+
 // SetupHLSConversion prepares for ffmpeg conversion
 func (s *Session) SetupHLSConversion() error {
-	s.currentVideo.Status = VIDEOSTATUS_WAITING_FOR_CONVERSION
-	filename := filepath.Base(s.currentVideo.FileLocation)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setupHLSConversion(s.currentVideo)
+}
+
+// convert probes the file of a video and schedules its HLS conversion. It must be called
+// without holding mu.
+func (s *Session) convert(video *Video) error {
+	s.probeFile(video)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setupHLSConversion(video)
+}
+
+// setupHLSConversion schedules the conversion of a video, mu must be held
+func (s *Session) setupHLSConversion(video *Video) error {
+	if video.StreamURL != "" {
+		// converted before the session was paused
+		video.Status = VIDEOSTATUS_COMPLETED
+		return nil
+	}
+	video.Status = VIDEOSTATUS_WAITING_FOR_CONVERSION
+	filename := filepath.Base(video.FileLocation)
 	hlsPath := strings.TrimSuffix(helper.SHAFromString(filename), "=")
 
-	newFolder := filepath.Join("/media/hls", hlsPath)
+	newFolder := filepath.Join(s.config.HLSRoot, hlsPath)
 	os.Mkdir(newFolder, 0755)
 	hlsFilename := filepath.Join(newFolder, hlsPath+".m3u8")
 
-	fmt.Printf("HLS files will be saved to %s\n", hlsFilename)
-	s.currentVideo.Status = VIDEOSTATUS_WAITING_FOR_CONVERSION
-
-	fmt.Printf("ffmpeg conversion scheduled for %s\n", filename)
+	s.videoLogger(video).Info("HLS conversion scheduled", "input", filename, "output", hlsFilename)
 	s.ffmpegWg.Add(1)
 	go func(source string, target string, video *Video) {
 		defer s.ffmpegWg.Done()
-		s.ffmpegQueue <- true
-		fmt.Printf("Starting ffmpeg conversion\n")
-		video.Status = VIDEOSTATUS_CONVERTING_TO_HLS
-		StartHLSConversion(source, target, video, &s.sessionPID)
-		<-s.ffmpegQueue
-	}(s.currentVideo.FileLocation, hlsFilename, s.currentVideo)
+		for attempt := 1; ; attempt++ {
+			s.ffmpegQueue <- true
+			s.mu.Lock()
+			if s.interrupted {
+				// shutting down, the conversion runs again when the session is resumed
+				video.Status = VIDEOSTATUS_PAUSED
+				s.mu.Unlock()
+				<-s.ffmpegQueue
+				s.notify()
+				return
+			}
+			video.Status = VIDEOSTATUS_CONVERTING_TO_HLS
+			s.mu.Unlock()
+			s.notify()
+			err := s.StartHLSConversion(source, target, video)
+			<-s.ffmpegQueue
+			var toolErr *ToolError
+			if attempt < maxConversionAttempts && errors.As(err, &toolErr) && toolErr.Code == ERRCODE_STALLED {
+				// the slot was released, the conversion queues up behind the waiting ones
+				s.mu.Lock()
+				video.Status = VIDEOSTATUS_WAITING_FOR_CONVERSION
+				s.mu.Unlock()
+				s.notify()
+				continue
+			}
+			s.notify()
+			return
+		}
+	}(video.FileLocation, hlsFilename, video)
 	return nil
 }
 
 // Extract playback duration using ffprobe
-func GetMediaPlaybackDuration(input string) string {
+func GetMediaPlaybackDuration(runner ToolRunner, input string) string {
 	durationString := ""
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
-	duration, err := cmd.Output()
+	duration, err := runTool(runner, TOOL_FFPROBE, "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
 	if err != nil {
-		fmt.Printf("Unable to obtain the duration of the file, %s", err.Error())
+		slog.Warn("unable to obtain the duration of the file", "input", input, "error", err)
 	} else {
 
 		duration_parts := strings.Split(string(duration), ".")
@@ -410,12 +844,11 @@ func GetMediaPlaybackDuration(input string) string {
 }
 
 // Get media resolution using ffprobe
-func GetMediaResolution(input string) string {
+func GetMediaResolution(runner ToolRunner, input string) string {
 
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", input)
-	stdout, err := cmd.Output()
+	stdout, err := runTool(runner, TOOL_FFPROBE, "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", input)
 	if err != nil {
-		fmt.Printf("Unable to obtain the resolution of the file, %s", err.Error())
+		slog.Warn("unable to obtain the resolution of the file", "input", input, "error", err)
 		return ""
 	} else {
 		format := string(stdout)
@@ -424,7 +857,46 @@ func GetMediaResolution(input string) string {
 	}
 }
 
+// HasAudioStream reports whether the file has an audio stream. A file which cannot be
+// probed is assumed to have one.
+func HasAudioStream(runner ToolRunner, input string) bool {
+	stdout, err := runTool(runner, TOOL_FFPROBE, "-v", "error", "-select_streams", "a", "-show_entries", "stream=index", "-of", "csv=p=0", input)
+	if err != nil {
+		slog.Warn("unable to obtain the audio streams of the file", "input", input, "error", err)
+		return true
+	}
+	return strings.TrimSpace(string(stdout)) != ""
+}
+
+// GetFileSpecs probes the file of the current video
 func (s *Session) GetFileSpecs() {
-	s.currentVideo.Duration = GetMediaPlaybackDuration(s.currentVideo.FileLocation)
-	s.currentVideo.Resolution = GetMediaResolution(s.currentVideo.FileLocation)
+	s.mu.RLock()
+	video := s.currentVideo
+	s.mu.RUnlock()
+	if video != nil {
+		s.probeFile(video)
+	}
+}
+
+// probeFile reads the duration and resolution of the file of a video with ffprobe. It must
+// be called without holding mu, probing a large file takes a while and snapshots of the
+// session are not held up meanwhile.
+func (s *Session) probeFile(video *Video) {
+	s.mu.RLock()
+	location := video.FileLocation
+	audioOnly := s.Options.AudioOnly
+	s.mu.RUnlock()
+
+	duration := GetMediaPlaybackDuration(s.runner, location)
+	resolution := ""
+	if !audioOnly {
+		resolution = GetMediaResolution(s.runner, location)
+	}
+
+	s.mu.Lock()
+	video.Duration = duration
+	if !audioOnly {
+		video.Resolution = resolution
+	}
+	s.mu.Unlock()
 }
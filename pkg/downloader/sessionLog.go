@@ -0,0 +1,178 @@
+// Capture of the complete output of the tools run for a session. Every session writes
+// to its own file which is rotated once it exceeds the configured size, keeping one
+// previous generation next to it.
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSessionLogDisabled = fmt.Errorf("session logs are disabled")
+
+// Sources of the lines in a session log
+const (
+	LOGSOURCE_YTDLP_STDOUT  = "yt-dlp"
+	LOGSOURCE_YTDLP_STDERR  = "yt-dlp:stderr"
+	LOGSOURCE_FFMPEG_STDERR = "ffmpeg:stderr"
+	LOGSOURCE_SERVER        = "server"
+)
+
+// sessionLog appends timestamped lines to the log file of a session. The file is opened
+// on the first write and kept open until Close. A nil *sessionLog discards everything.
+type sessionLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	removed  bool // writes after Remove are dropped
+}
+
+// newSessionLog returns the log of a session, nil if session logs are disabled
+func newSessionLog(config *Config, id string) *sessionLog {
+	if config.SessionLogDir == "" {
+		return nil
+	}
+	return &sessionLog{
+		path:     sessionLogPath(config, id),
+		maxBytes: int64(config.SessionLogMaxBytes),
+	}
+}
+
+// sessionLogPath returns the current log file of a session. The previous generation
+// has the suffix ".1".
+func sessionLogPath(config *Config, id string) string {
+	return filepath.Join(config.SessionLogDir, id+".log")
+}
+
+// WriteLine records one line of output of the given source
+func (l *sessionLog) WriteLine(source string, line string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.removed {
+		return
+	}
+	if err := l.open(); err != nil {
+		return
+	}
+	entry := fmt.Sprintf("%s [%s] %s\n", time.Now().Format(time.RFC3339), source, strings.TrimRight(line, "\r\n"))
+	if l.size > 0 && l.size+int64(len(entry)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			slog.Warn("unable to rotate session log", "path", l.path, "error", err)
+			return
+		}
+	}
+	n, err := io.WriteString(l.file, entry)
+	l.size += int64(n)
+	if err != nil {
+		slog.Warn("unable to write session log", "path", l.path, "error", err)
+	}
+}
+
+// Copy records every line read from r until EOF. Each line is also passed to observe
+// if it is not nil.
+func (l *sessionLog) Copy(source string, r io.Reader, observe func(line string)) {
+	buffer := make([]byte, 0, 4096)
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		buffer = append(buffer, chunk[:n]...)
+		for {
+			// ffmpeg ends its status lines with \r only
+			i := bytes.IndexAny(buffer, "\r\n")
+			if i < 0 {
+				break
+			}
+			if i > 0 {
+				l.WriteLine(source, string(buffer[:i]))
+				if observe != nil {
+					observe(string(buffer[:i]))
+				}
+			}
+			buffer = buffer[i+1:]
+		}
+		if err != nil {
+			if len(buffer) > 0 {
+				l.WriteLine(source, string(buffer))
+				if observe != nil {
+					observe(string(buffer))
+				}
+			}
+			return
+		}
+	}
+}
+
+// open opens the log file for appending if needed, mu must be held
+func (l *sessionLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Warn("unable to open session log", "path", l.path, "error", err)
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to the previous generation and starts a new one, mu must be held
+func (l *sessionLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the log file, it is opened again by the next write
+func (l *sessionLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// Remove closes the log and deletes its files
+func (l *sessionLog) Remove() {
+	if l == nil {
+		return
+	}
+	l.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removed = true
+	for _, path := range []string{l.path, l.path + ".1"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("unable to remove session log", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestSession returns a session whose conversions are replayed by runner
+func newTestSession(t *testing.T, runner ToolRunner) *Session {
+	t.Helper()
+	config := testConfig(t)
+	var wg sync.WaitGroup
+	session := NewSession("sha", "https://example.com/playlist", make(chan bool, 1), &wg)
+	session.config = &config
+	session.runner = runner
+	t.Cleanup(wg.Wait)
+	return session
+}
+
+func TestParsePlaylistSequence(t *testing.T) {
+	session := newTestSession(t, NewFakeRunner())
+	folder := t.TempDir()
+	item := 0
+	for _, line := range playlistOutput(folder, "Recorded playlist", 3, 2) {
+		if !hasValidPrefix(line) {
+			continue
+		}
+		if err := session.Parse(line); err != nil {
+			t.Fatalf("Parse(%q): %v", line, err)
+		}
+		if strings.HasPrefix(line, string(STDOUT_PLAYLIST_SEQ)) {
+			item++
+			snapshot := session.Snapshot()
+			if snapshot.Playlist_seq != item || snapshot.Playlist_count != 3 {
+				t.Errorf("after %q: playlist position %d of %d, want %d of 3",
+					line, snapshot.Playlist_seq, snapshot.Playlist_count, item)
+			}
+		}
+	}
+	if item != 3 {
+		t.Fatalf("announced %d playlist items, want 3", item)
+	}
+	if state := session.currentState(); state != STATE_HLS_CONVERSION {
+		t.Errorf("state after the playlist is %d, want STATE_HLS_CONVERSION", state)
+	}
+	if snapshot := session.Snapshot(); len(snapshot.Videos) != 3 || !snapshot.IsPlaylist || snapshot.Title != "Recorded playlist" {
+		t.Errorf("got %d videos of playlist %v %q, want 3 videos of playlist %q",
+			len(snapshot.Videos), snapshot.IsPlaylist, snapshot.Title, "Recorded playlist")
+	}
+}
+
+// TestParseSubtitleDownload parses a video downloaded with --write-subs and recoded into
+// webm. The subtitle files are announced like media streams and must not become one.
+func TestParseSubtitleDownload(t *testing.T) {
+	session := newTestSession(t, NewFakeRunner())
+	folder := t.TempDir()
+	base := folder + "/1-Video"
+	lines := videoOutput(folder, "abc", "Video", 1, 1, 2)
+	subtitles := []string{"[info] Writing video subtitles to: " + base + ".en.vtt"}
+	for _, language := range []string{"en", "pt-BR"} {
+		subtitles = append(subtitles, "[download] Destination: "+base+"."+language+".vtt",
+			progressLine("abc", "Video", 1, 1, "downloading", 512, 1024),
+			progressLine("abc", "Video", 1, 1, "finished", 1024, 1024),
+			"[download] Download completed")
+	}
+	lines = append(append(lines[:1:1], subtitles...), lines[1:len(lines)-1]...)
+	lines = append(lines, "[VideoConvertor] Converting video from mkv to webm; Destination: "+base+".webm")
+
+	for _, line := range lines {
+		if !hasValidPrefix(line) {
+			continue
+		}
+		if err := session.Parse(line); err != nil {
+			t.Fatalf("Parse(%q): %v", line, err)
+		}
+	}
+	snapshot := session.Snapshot()
+	if state := session.currentState(); state != STATE_REMUX {
+		t.Fatalf("state after the download is %d, want STATE_REMUX", state)
+	}
+	if len(snapshot.Videos) != 1 {
+		t.Fatalf("got %d videos, want 1", len(snapshot.Videos))
+	}
+	video := snapshot.Videos[0]
+	if len(video.SubStream) != 2 {
+		t.Errorf("got %d substreams, want the video and audio formats", len(video.SubStream))
+	}
+	for _, substream := range video.SubStream {
+		if strings.HasSuffix(substream.Destination, ".vtt") {
+			t.Errorf("subtitle file %s recorded as a substream", substream.Destination)
+		}
+	}
+	if video.FileLocation != base+".webm" {
+		t.Errorf("file location %q, want the recoded %q", video.FileLocation, base+".webm")
+	}
+}
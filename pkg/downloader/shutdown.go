@@ -0,0 +1,124 @@
+// Graceful shutdown of the DownloadManager. Running downloads are paused so that yt-dlp
+// continues from its .part files after a restart, HLS conversions are given the grace
+// period to finish and are interrupted afterwards. All sessions are persisted at the end.
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errConversionInterrupted is returned by StartHLSConversion when Shutdown stopped ffmpeg
+var errConversionInterrupted = errors.New("the HLS conversion was interrupted by shutdown")
+
+// shutdownPollInterval is how often Shutdown checks whether the downloaders have stopped
+const shutdownPollInterval = 100 * time.Millisecond
+
+// shutdownCheckpointWait bounds the wait for interrupted conversions once the grace period is over
+const shutdownCheckpointWait = 5 * time.Second
+
+// IsShuttingDown reports whether Shutdown has been called
+func (dm *DownloadManager) IsShuttingDown() bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.closing
+}
+
+// Shutdown stops accepting new downloads and pauses the running ones. HLS conversions
+// which are already running or pending continue until ctx is done, then they are
+// interrupted and their videos are left paused so that resuming the session converts
+// them again. Returns ctx.Err() if conversions had to be interrupted.
+func (dm *DownloadManager) Shutdown(ctx context.Context) error {
+	dm.mu.Lock()
+	dm.closing = true
+	downloaders := make([]*Downloader, 0, len(dm.Downloaders))
+	for _, downloader := range dm.Downloaders {
+		downloaders = append(downloaders, downloader)
+	}
+	dm.mu.Unlock()
+
+	slog.Info("shutting down downloads", "downloaders", len(downloaders))
+	for _, downloader := range downloaders {
+		// downloads which are not running or only converting cannot be paused
+		downloader.Pause()
+	}
+
+	var err error
+	if !waitIdle(ctx, downloaders) {
+		err = ctx.Err()
+		slog.Warn("grace period expired, stopping yt-dlp and HLS conversions")
+		var wg sync.WaitGroup
+		for _, downloader := range downloaders {
+			wg.Add(1)
+			go func(downloader *Downloader) {
+				defer wg.Done()
+				// partial files are kept so that the download can be resumed
+				if result := downloader.stopProcesses(); result.Err != nil {
+					downloader.logger().Error("unable to stop download", "error", result.Err)
+				}
+			}(downloader)
+		}
+		wg.Wait()
+		checkpointCtx, cancel := context.WithTimeout(context.Background(), shutdownCheckpointWait)
+		if !waitIdle(checkpointCtx, downloaders) {
+			slog.Error("downloads still running after shutdown")
+		}
+		cancel()
+	}
+
+	for _, downloader := range downloaders {
+		if session := downloader.session(); session != nil {
+			dm.saveSession(session)
+		}
+	}
+	return err
+}
+
+// waitIdle waits until none of the downloaders is running. Returns false if ctx is done first.
+func waitIdle(ctx context.Context, downloaders []*Downloader) bool {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		idle := true
+		for _, downloader := range downloaders {
+			downloader.mu.Lock()
+			active := downloader.active
+			downloader.mu.Unlock()
+			if active {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// interrupt stops the running HLS conversion of the session and prevents pending ones
+// from starting. The affected videos are paused instead of failing.
+func (s *Session) interrupt() (StopResult, error) {
+	s.mu.Lock()
+	s.interrupted = true
+	process := s.ffmpegProcess
+	s.mu.Unlock()
+	if process != nil {
+		s.logger().Info("interrupting HLS conversion", "pid", process.Pid())
+	}
+	return terminateProcess(process, terminateGracePeriod)
+}
+
+// isInterrupted reports whether interrupt has been called since the last run started
+func (s *Session) isInterrupted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.interrupted
+}
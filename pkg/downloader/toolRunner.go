@@ -0,0 +1,192 @@
+// Abstraction of the external tools (yt-dlp, ffmpeg and ffprobe) used by the downloader.
+// The DownloadManager is built with a ToolRunner so that the binaries can be relocated
+// or replaced by a fake implementation.
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Tool identifies an external program
+type Tool string
+
+const (
+	TOOL_YTDLP   Tool = "yt-dlp"
+	TOOL_FFMPEG  Tool = "ffmpeg"
+	TOOL_FFPROBE Tool = "ffprobe"
+)
+
+// Process is a running instance of a Tool. It runs in its own process group together
+// with the processes it starts, e.g. the ffmpeg instances of yt-dlp.
+// Stdout and Stderr must be read until EOF before calling Wait.
+type Process interface {
+	Pid() int
+	Stdout() io.Reader
+	Stderr() io.Reader
+	Wait() error
+	// Exited is closed once Wait has returned
+	Exited() <-chan bool
+	// Terminate asks the process group to stop with SIGTERM
+	Terminate() error
+	// Kill stops the process group immediately with SIGKILL
+	Kill() error
+}
+
+// ToolRunner starts external tools
+type ToolRunner interface {
+	Start(tool Tool, args ...string) (Process, error)
+}
+
+// ExecRunner starts the real binaries through os/exec
+type ExecRunner struct {
+	paths map[Tool]string
+}
+
+// NewExecRunner returns an ExecRunner. paths maps a Tool to the binary to invoke,
+// tools without an entry are looked up in PATH by their name.
+func NewExecRunner(paths map[Tool]string) *ExecRunner {
+	runner := &ExecRunner{paths: make(map[Tool]string)}
+	for tool, path := range paths {
+		if path != "" {
+			runner.paths[tool] = path
+		}
+	}
+	return runner
+}
+
+// Path returns the binary invoked for the tool
+func (r *ExecRunner) Path(tool Tool) string {
+	if path, ok := r.paths[tool]; ok {
+		return path
+	}
+	return string(tool)
+}
+
+func (r *ExecRunner) Start(tool Tool, args ...string) (Process, error) {
+	cmd := exec.Command(r.Path(tool), args...)
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error opening stdout of %s %w", tool, err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error opening stderr of %s %w", tool, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error when starting %s %w", tool, err)
+	}
+	return &execProcess{cmd: cmd, stdout: stdout, stderr: stderr, exited: make(chan bool)}, nil
+}
+
+type execProcess struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr io.Reader
+	once   sync.Once
+	err    error
+	exited chan bool
+}
+
+func (p *execProcess) Pid() int { return p.cmd.Process.Pid }
+
+func (p *execProcess) Stdout() io.Reader { return p.stdout }
+
+func (p *execProcess) Stderr() io.Reader { return p.stderr }
+
+func (p *execProcess) Wait() error {
+	p.once.Do(func() {
+		p.err = p.cmd.Wait()
+		close(p.exited)
+	})
+	return p.err
+}
+
+func (p *execProcess) Exited() <-chan bool { return p.exited }
+
+func (p *execProcess) Terminate() error {
+	return signalProcessGroup(p.cmd.Process, syscall.SIGTERM)
+}
+
+func (p *execProcess) Kill() error {
+	return signalProcessGroup(p.cmd.Process, syscall.SIGKILL)
+}
+
+// StopResult describes how terminateProcess stopped a process
+type StopResult string
+
+const (
+	STOP_NOT_RUNNING StopResult = "notRunning" // there was no process to stop
+	STOP_TERMINATED  StopResult = "terminated" // the process exited after SIGTERM
+	STOP_KILLED      StopResult = "killed"     // the process did not exit within the grace period and was killed
+	STOP_FAILED      StopResult = "failed"     // the process could not be signalled or survived SIGKILL
+)
+
+const (
+	// terminateGracePeriod is how long a process may take to exit after SIGTERM
+	terminateGracePeriod = 10 * time.Second
+	// killTimeout is how long a process may take to exit after SIGKILL
+	killTimeout = 5 * time.Second
+)
+
+// terminateProcess stops a process, escalating from SIGTERM to SIGKILL when it has not
+// exited after grace. The owner of the process must keep reading its output and call Wait,
+// terminateProcess only observes the exit. A nil process is not running.
+func terminateProcess(process Process, grace time.Duration) (StopResult, error) {
+	if process == nil {
+		return STOP_NOT_RUNNING, nil
+	}
+	select {
+	case <-process.Exited():
+		return STOP_NOT_RUNNING, nil
+	default:
+	}
+	if err := process.Terminate(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return STOP_FAILED, fmt.Errorf("unable to terminate process %d %w", process.Pid(), err)
+	}
+	select {
+	case <-process.Exited():
+		return STOP_TERMINATED, nil
+	case <-time.After(grace):
+	}
+	if err := process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return STOP_FAILED, fmt.Errorf("unable to kill process %d %w", process.Pid(), err)
+	}
+	select {
+	case <-process.Exited():
+		return STOP_KILLED, nil
+	case <-time.After(killTimeout):
+		return STOP_FAILED, fmt.Errorf("process %d did not exit after SIGKILL", process.Pid())
+	}
+}
+
+// runTool starts a tool, collects its entire stdout and waits for it to exit.
+// The stderr output of a failed run is appended to the error.
+func runTool(runner ToolRunner, tool Tool, args ...string) ([]byte, error) {
+	process, err := runner.Start(tool, args...)
+	if err != nil {
+		return nil, err
+	}
+	stderr := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(process.Stderr())
+		stderr <- data
+	}()
+	output, readErr := io.ReadAll(process.Stdout())
+	errOutput := <-stderr
+	if err := process.Wait(); err != nil {
+		if message := strings.TrimSpace(string(errOutput)); message != "" {
+			return output, fmt.Errorf("%w: %s", err, message)
+		}
+		return output, err
+	}
+	return output, readErr
+}
@@ -0,0 +1,193 @@
+// Users sharing one server. Every session records the users who requested its URL, the
+// media of a URL is downloaded once and shared by all of them. Each user may be limited in
+// the number of concurrent downloads and in the storage used by their sessions.
+package downloader
+
+import (
+	"fmt"
+	"slices"
+)
+
+var ErrQuotaExceeded = fmt.Errorf("the storage quota of the user is used up")
+
+// UserLimits restricts the downloads of a user. In the limits of a specific user, zero
+// values are taken from the default limits. A shared download counts for every owner, it
+// waits for a slot of the user who requested it and occupies one of each other owner
+// while yt-dlp runs.
+type UserLimits struct {
+	MaxConcurrent int   `json:"maxConcurrent,omitempty"` // downloads of the user running at the same time, 0 for no limit
+	QuotaBytes    int64 `json:"quotaBytes,omitempty"`    // storage used by the sessions of the user, 0 for no limit
+}
+
+// Validate reports the first invalid setting
+func (l UserLimits) Validate() error {
+	if l.MaxConcurrent < 0 {
+		return fmt.Errorf("maxConcurrent cannot be negative, got %d", l.MaxConcurrent)
+	}
+	if l.QuotaBytes < 0 {
+		return fmt.Errorf("quotaBytes cannot be negative, got %d", l.QuotaBytes)
+	}
+	return nil
+}
+
+// inherit fills the zero values of l from base
+func (l UserLimits) inherit(base UserLimits) UserLimits {
+	if l.MaxConcurrent == 0 {
+		l.MaxConcurrent = base.MaxConcurrent
+	}
+	if l.QuotaBytes == 0 {
+		l.QuotaBytes = base.QuotaBytes
+	}
+	return l
+}
+
+// userLimits returns the limits of a user, "" stands for the downloads of an
+// unauthenticated server which are not limited
+func (c Config) userLimits(user string) UserLimits {
+	if user == "" {
+		return UserLimits{}
+	}
+	if limits, ok := c.Users[user]; ok {
+		return limits.inherit(c.UserLimits)
+	}
+	return c.UserLimits
+}
+
+// userQueue returns the queue limiting the concurrent downloads of a user, nil if they
+// are not limited. dm.mu must be held.
+func (dm *DownloadManager) userQueue(user string) *slotQueue {
+	limits := dm.config.userLimits(user)
+	if limits.MaxConcurrent == 0 {
+		return nil
+	}
+	queue, ok := dm.UserQueues[user]
+	if !ok {
+		queue = newSlotQueue(limits.MaxConcurrent)
+		dm.UserQueues[user] = queue
+	}
+	return queue
+}
+
+// ownerQueue returns the queue of a user sharing a download, nil if they are not limited
+func (dm *DownloadManager) ownerQueue(user string) *slotQueue {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.userQueue(user)
+}
+
+// Usage returns the bytes used by the sessions of a user. Shared media counts for each
+// of its owners.
+func (dm *DownloadManager) Usage(user string) int64 {
+	var used int64
+	for _, session := range dm.Sessions() {
+		if !slices.Contains(session.Owners, user) {
+			continue
+		}
+		if session.BytesTotal > session.BytesDownloaded {
+			used += session.BytesTotal
+		} else {
+			used += session.BytesDownloaded
+		}
+	}
+	return used
+}
+
+// quotaError returns ErrQuotaExceeded if every owner of a download has used up their
+// quota, a download continues as long as one of them has room for it. A running download
+// is stopped when it takes its owners beyond their quota, a new one is refused once the
+// quota is reached.
+func (dm *DownloadManager) quotaError(owners []string, running bool) error {
+	var err error
+	for _, owner := range owners {
+		quota := dm.config.userLimits(owner).QuotaBytes
+		if quota == 0 {
+			return nil
+		}
+		used := dm.Usage(owner)
+		if used < quota || (running && used == quota) {
+			return nil
+		}
+		err = fmt.Errorf("%w: %d of %d bytes used by %s", ErrQuotaExceeded, used, quota, owner)
+	}
+	return err
+}
+
+// runningQuotaError checks the quota of the owners of a running download
+func (dm *DownloadManager) runningQuotaError(owners []string) error {
+	return dm.quotaError(owners, true)
+}
+
+// AddOwner shares the session of shaKey with another user
+func (dm *DownloadManager) AddOwner(shaKey string, user string) error {
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return ErrSessionNotFound
+	}
+	queue := dm.ownerQueue(user)
+	downloader.mu.Lock()
+	session := downloader.currentSession
+	downloader.owners = appendOwner(downloader.owners, user)
+	if downloader.sharedSlots != nil && queue != nil && queue != downloader.userQueue && downloader.sharedSlots[user] == nil {
+		// the running download counts for the new owner from now on
+		queue.take()
+		downloader.sharedSlots[user] = queue
+	}
+	downloader.mu.Unlock()
+	if session != nil {
+		session.addOwner(user)
+	}
+	return nil
+}
+
+// RemoveOwner stops sharing the session of shaKey with a user. The download itself is
+// left alone, see CancelDownload.
+func (dm *DownloadManager) RemoveOwner(shaKey string, user string) error {
+	downloader := dm.FindDownloader(shaKey)
+	if downloader == nil {
+		return ErrSessionNotFound
+	}
+	downloader.mu.Lock()
+	session := downloader.currentSession
+	downloader.owners = slices.DeleteFunc(downloader.owners, func(owner string) bool { return owner == user })
+	if queue := downloader.sharedSlots[user]; queue != nil {
+		delete(downloader.sharedSlots, user)
+		queue.Release()
+	}
+	downloader.mu.Unlock()
+	if session != nil {
+		session.removeOwner(user)
+	}
+	return nil
+}
+
+// appendOwner adds user to owners unless it is listed already or empty
+func appendOwner(owners []string, user string) []string {
+	if user == "" || slices.Contains(owners, user) {
+		return owners
+	}
+	return append(owners, user)
+}
+
+// addOwner records another user of the session
+func (s *Session) addOwner(user string) {
+	s.mu.Lock()
+	s.Owners = appendOwner(s.Owners, user)
+	s.mu.Unlock()
+	s.notify()
+}
+
+// removeOwner removes a user of the session
+func (s *Session) removeOwner(user string) {
+	s.mu.Lock()
+	s.Owners = slices.DeleteFunc(s.Owners, func(owner string) bool { return owner == user })
+	s.mu.Unlock()
+	s.notify()
+}
+
+// IsVisibleTo reports whether a user may see the session. Sessions without owners were
+// created before users were introduced and are visible to everyone.
+func (s *Session) IsVisibleTo(user string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Owners) == 0 || slices.Contains(s.Owners, user)
+}
@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/store"
+)
+
+// newLimitedManager returns a DownloadManager applying limits to every user, starting
+// the tools through runner
+func newLimitedManager(t *testing.T, limits UserLimits, runner ToolRunner) *DownloadManager {
+	t.Helper()
+	config := DefaultConfig()
+	config.DownloadRoot = t.TempDir()
+	config.HLSRoot = t.TempDir()
+	config.SessionLogDir = ""
+	config.StallTimeout.Duration = 0
+	config.Retry.MaxAttempts = 1
+	config.UserLimits = limits
+	dm := NewDownloadManager(config, store.NopStore{}, runner)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dm.Shutdown(ctx)
+	})
+	return dm
+}
+
+// eventually polls condition until it holds, failing the test after a few seconds
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ytdlpRuns returns the number of yt-dlp invocations of runner
+func ytdlpRuns(runner *FakeRunner) int {
+	runs := 0
+	for _, call := range runner.Calls() {
+		if call.Tool == TOOL_YTDLP {
+			runs++
+		}
+	}
+	return runs
+}
+
+func TestSlotQueueTake(t *testing.T) {
+	queue := newSlotQueue(1)
+	queue.Acquire(func() int { return 0 }, nil)
+	queue.take()
+	acquired := make(chan bool)
+	go func() { acquired <- queue.Acquire(func() int { return 0 }, nil) }()
+	eventually(t, "the waiter", func() bool {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return len(queue.waiters) == 1
+	})
+
+	// the first release only brings the queue back to its capacity
+	queue.Release()
+	select {
+	case <-acquired:
+		t.Fatal("slot handed over while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	queue.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("slot not handed over once the queue has room")
+	}
+	if queue.used != 1 {
+		t.Errorf("%d slots used, want 1", queue.used)
+	}
+}
+
+// TestQuotaWhileDownloading stops a download whose size takes its owner beyond the quota
+func TestQuotaWhileDownloading(t *testing.T) {
+	lines := []string{"[info] abc: Downloading 1 format(s): 18", "[download] Destination: /tmp/Video.mp4"}
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf(`[progressbar]{"id":"abc","title":"Video","playlist":"","playlistIndex":1,"playlistCount":1,`+
+			`"progress":{"status":"downloading","downloaded_bytes":%d,"total_bytes":20480,"speed":1048576.0,"eta":3}}`, i*1024))
+	}
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{Stdout: strings.Join(lines, "\n") + "\n", Delay: time.Millisecond})
+	dm := newLimitedManager(t, UserLimits{QuotaBytes: 4096}, runner)
+
+	if err := dm.NewDownload("large", "https://example.com/watch?v=large", SessionOptions{}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the quota failure", func() bool {
+		code, failed := dm.FindDownloader("large").session().failure()
+		return failed && code == ERRCODE_QUOTA_EXCEEDED
+	})
+	if session := dm.Session("large"); session.ErrorMessage == "" || session.ErrorCode.Retryable() {
+		t.Errorf("session failed with %q (%s)", session.ErrorMessage, session.ErrorCode)
+	}
+
+	// the quota is used up, another download is refused but the media can be shared
+	err := dm.NewDownload("next", "https://example.com/watch?v=next", SessionOptions{}, "alice")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("NewDownload over the quota returned %v", err)
+	}
+	if err := dm.AddOwner("large", "alice"); err != nil {
+		t.Errorf("AddOwner over the quota returned %v", err)
+	}
+}
+
+// TestSharedDownloadSlots counts a running download for the user it is shared with
+func TestSharedDownloadSlots(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.Record(TOOL_YTDLP, FakeRecording{Stdout: "[info] shared: Downloading\n", Delay: time.Minute}, FakeRecording{})
+	dm := newLimitedManager(t, UserLimits{MaxConcurrent: 1}, runner)
+
+	if err := dm.NewDownload("shared", "https://example.com/watch?v=shared", SessionOptions{}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "yt-dlp to start", func() bool { return ytdlpRuns(runner) > 0 })
+	if err := dm.AddOwner("shared", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slot of bob is taken by the shared download, the download of bob waits for it
+	if err := dm.NewDownload("own", "https://example.com/watch?v=own", SessionOptions{}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the download to be queued", func() bool {
+		d := dm.FindDownloader("own")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.waiting
+	})
+	if calls := ytdlpRuns(runner); calls != 1 {
+		t.Errorf("%d yt-dlp runs while the slot of bob is taken, want 1", calls)
+	}
+
+	dm.CancelDownload("shared")
+	eventually(t, "the queued download to start", func() bool { return ytdlpRuns(runner) == 2 })
+}
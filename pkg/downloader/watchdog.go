@@ -0,0 +1,153 @@
+// Detection of stalled yt-dlp and ffmpeg processes. A hanging process keeps its slot in
+// the download or ffmpeg queue forever, the watchdog terminates it once it has shown no
+// activity for the configured window so that it can be rescheduled.
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yifeng-qiu/StreamSaver/pkg/helper"
+)
+
+// watchdog tracks the activity of one process. A nil *watchdog is disabled.
+type watchdog struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	last    time.Time // time of the last activity
+	marker  string    // last reported progress
+	stopped bool
+	// suspended while a post-processor of yt-dlp runs ffmpeg, which prints nothing until
+	// it is done. The next output resumes the watch.
+	suspended bool
+	done      chan bool
+	once      sync.Once
+}
+
+// newWatchdog returns a watchdog calling onStall once when there was no activity for
+// timeout. Returns nil if timeout is not positive.
+func newWatchdog(timeout time.Duration, onStall func()) *watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &watchdog{timeout: timeout, last: time.Now(), done: make(chan bool)}
+	go w.run(onStall)
+	return w
+}
+
+func (w *watchdog) run(onStall func()) {
+	interval := w.timeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			stalled := !w.stopped && !w.suspended && now.Sub(w.last) >= w.timeout
+			w.mu.Unlock()
+			if stalled {
+				onStall()
+				return
+			}
+		}
+	}
+}
+
+// activity records output of the process which is not a progress report
+func (w *watchdog) activity() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.last = time.Now()
+	w.suspended = false
+	w.mu.Unlock()
+}
+
+// suspend stops the watch until the next activity or progress report
+func (w *watchdog) suspend() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.last = time.Now()
+	w.suspended = true
+	w.mu.Unlock()
+}
+
+// progress records a progress report. Only a change of marker counts as activity,
+// a process repeating the same progress is not moving.
+func (w *watchdog) progress(marker string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if marker != w.marker {
+		w.marker = marker
+		w.last = time.Now()
+	}
+	w.suspended = false
+	w.mu.Unlock()
+}
+
+// Stop ends the watch, onStall is not called afterwards
+func (w *watchdog) Stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+	w.once.Do(func() { close(w.done) })
+}
+
+// maxConversionAttempts is the number of times a stalled HLS conversion is started
+const maxConversionAttempts = 2
+
+// watchFFmpegProgress reads the -progress output of ffmpeg until EOF and reports every
+// block to the watchdog. The position and size of the output identify the progress.
+func watchFFmpegProgress(stdout io.Reader, watch *watchdog) {
+	scanner := bufio.NewScanner(stdout)
+	marker := ""
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "out_time_us", "total_size":
+			marker += value + ":"
+		case "progress":
+			// last line of a block
+			watch.progress(marker)
+			marker = ""
+		}
+	}
+	io.Copy(io.Discard, stdout)
+}
+
+// markStall records a stalled process on the session
+func (s *Session) markStall() {
+	s.mu.Lock()
+	s.Stalls++
+	s.LastStall = &helper.TimeWithoutNanoseconds{Time: time.Now()}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// progressMarker describes the download progress of the current video
+func (s *Session) progressMarker() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.currentVideo == nil || s.currentVideo.currentSubstream == nil {
+		return ""
+	}
+	substream := s.currentVideo.currentSubstream
+	return fmt.Sprintf("%d:%d:%.1f:%s", s.currentVideo.Index, substream.Index, substream.Progress, substream.Size)
+}
@@ -0,0 +1,51 @@
+package downloader
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogSuspendedDuringPostprocessing(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	var stalled atomic.Bool
+	watch := newWatchdog(timeout, func() { stalled.Store(true) })
+	defer watch.Stop()
+
+	for _, line := range []string{`[Merger] Merging formats into "/media/download/video.mp4"`,
+		"[EmbedThumbnail] ffmpeg: Adding thumbnail to \"/media/download/video.mp4\""} {
+		if !isPostprocessorMessage(line) {
+			t.Fatalf("%q is not recognised as a post-processor message", line)
+		}
+		watch.suspend()
+		time.Sleep(5 * timeout)
+		if stalled.Load() {
+			t.Fatalf("stalled while suspended after %q", line)
+		}
+		watch.activity()
+	}
+
+	time.Sleep(5 * timeout)
+	if !stalled.Load() {
+		t.Fatal("not stalled without activity after the post-processors")
+	}
+}
+
+func TestPostprocessorMessages(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`[VideoRemuxer] Remuxing video from webm to mp4; Destination: /media/download/video.mp4`, true},
+		{`[ExtractAudio] Destination: /media/download/audio.m4a`, true},
+		{`[FixupM3u8] Fixing MPEG-TS in MP4 container of "/media/download/video.mp4"`, true},
+		{`[download] Destination: /media/download/video.f137.mp4`, false},
+		{`[progressbar]{"id":"abc"}`, false},
+		{`Deleting original file /media/download/video.f137.mp4 (pass -k to keep)`, false},
+	}
+	for _, test := range tests {
+		if got := isPostprocessorMessage(test.line); got != test.want {
+			t.Errorf("isPostprocessorMessage(%q) = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package helper
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -28,3 +29,34 @@ func SHAFromString(urlstring string) string {
 	sha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 	return sha
 }
+
+// Duration is a wrapper for time.Duration which is encoded in JSON as a string such as "15s"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON encodes the duration in the format of time.Duration.String
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts a duration string such as "1m30s" or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
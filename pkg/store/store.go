@@ -0,0 +1,126 @@
+// Package store persists server state, such as requests and download sessions,
+// so that it survives a restart of the server.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store is implemented by any backend capable of saving records.
+// Records are grouped by kind (e.g. "requests", "sessions") and identified by a key.
+type Store interface {
+	// Put saves v under kind and key, replacing any previous record
+	Put(kind string, key string, v any) error
+	// Delete removes a record. Deleting a missing record is not an error
+	Delete(kind string, key string) error
+	// Load calls fn with the raw JSON of every record of the given kind
+	Load(kind string, fn func(key string, data []byte) error) error
+}
+
+var ErrInvalidKey = fmt.Errorf("invalid store key")
+
+// FileStore saves every record as a JSON file under Dir/kind/key.json
+type FileStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create state directory %w", err)
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (fs *FileStore) path(kind string, key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(fs.Dir, kind, key+".json"), nil
+}
+
+// Put writes the record to a temporary file first and renames it, so that a crash
+// never leaves a half written record behind.
+func (fs *FileStore) Put(kind string, key string, v any) error {
+	target, err := fs.path(kind, key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode record %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func (fs *FileStore) Delete(kind string, key string) error {
+	target, err := fs.path(kind, key)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) Load(kind string, fn func(key string, data []byte) error) error {
+	fs.mu.Lock()
+	entries, err := os.ReadDir(filepath.Join(fs.Dir, kind))
+	fs.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(fs.Dir, kind, name))
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimSuffix(name, ".json"), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NopStore discards every record. It is used when persistence is disabled.
+type NopStore struct{}
+
+func (NopStore) Put(kind string, key string, v any) error { return nil }
+
+func (NopStore) Delete(kind string, key string) error { return nil }
+
+func (NopStore) Load(kind string, fn func(key string, data []byte) error) error { return nil }